@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/api"
+	"github.com/censys/scan-takehome/pkg/ingester/repository"
+	"github.com/censys/scan-takehome/pkg/log"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/knadh/koanf/providers/env/v2"
+	"github.com/knadh/koanf/v2"
+	"go.uber.org/zap"
+)
+
+func main() {
+	k := koanf.New(".")
+	loadConfigValues(k)
+	level := k.String("log.level")
+	output := k.String("log.output")
+	addr := k.String("addr")
+	if addr == "" {
+		addr = ":8080"
+	}
+
+	dbURL := fmt.Sprintf(
+		"postgres://%s:%s@%s:%d/%s?sslmode=%s",
+		k.String("postgres.user"),
+		k.String("postgres.password"),
+		k.String("postgres.host"),
+		k.Int("postgres.port"),
+		k.String("postgres.db"),
+		k.String("postgres.ssl.mode"),
+	)
+
+	l, err := log.New(level, output)
+	if err != nil {
+		println("failed to create logger: ", err.Error())
+		os.Exit(1)
+	}
+	l.Info("starting api service...")
+	ctx, fn := context.WithCancel(context.Background())
+	defer fn()
+
+	conn, err := pgxpool.New(ctx, dbURL)
+	if err != nil {
+		l.Fatal("failed to get postgres connection", zap.Error(err))
+	}
+	defer conn.Close()
+
+	repo := repository.NewPostgresRepository(conn)
+
+	var opts []api.ServerOption
+	if defaultSize, maxSize := k.Int("page.size.default"), k.Int("page.size.max"); defaultSize > 0 && maxSize > 0 {
+		opts = append(opts, api.WithPageSize(defaultSize, maxSize))
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           api.NewServer(l, repo, opts...),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	go func() {
+		l.Info("listening", zap.String("addr", addr))
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Fatal("api server failed", zap.Error(err))
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigs
+
+	l.Info("shutdown signal received, finishing up....")
+	shutdownCtx, shutdownFn := context.WithTimeout(context.Background(), time.Second*30)
+	defer shutdownFn()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		l.Error("failed to shut down cleanly", zap.Error(err))
+	}
+
+	l.Info("goodbye!")
+}
+
+func loadConfigValues(k *koanf.Koanf) {
+	prefix := "API_"
+	k.Load(env.Provider(".", env.Opt{
+		Prefix: prefix,
+		TransformFunc: func(k, v string) (string, any) {
+			k = strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(k, prefix)), "_", ".")
+
+			if strings.Contains(v, " ") {
+				return k, strings.Split(v, " ")
+			}
+			return k, v
+		},
+	}), nil)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/censys/scan-takehome/pkg/ingester/cache"
+	"github.com/knadh/koanf/v2"
+	"go.uber.org/zap"
+)
+
+const cacheUsage = `usage: ingester cache <migrate|purge> [-dry-run] [-scan-count n]
+
+migrate  copy keys from an older cache key schema to the current one, then delete them
+purge    delete keys from an older cache key schema
+
+Redis is configured with the same INGESTER_REDIS_* settings as the ingester.
+`
+
+// runCommand runs one of the ingester's maintenance commands instead of the
+// ingester itself.
+func runCommand(k *koanf.Koanf, l *zap.Logger, args []string) error {
+	switch args[0] {
+	case "cache":
+		return runCacheCommand(k, l, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q, the only command is cache", args[0])
+	}
+}
+
+// runCacheCommand migrates or purges cache keys written with an older schema.
+// It's safe to run while ingesters are consuming.
+func runCacheCommand(k *koanf.Koanf, l *zap.Logger, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return errors.New("missing cache command")
+	}
+	fs := flag.NewFlagSet("cache "+args[0], flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), cacheUsage) }
+	dryRun := fs.Bool("dry-run", false, "only count the outdated keys")
+	scanCount := fs.Int64("scan-count", 1000, "keys to look at per SCAN")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	c, err := newRedisCache(ctx, k)
+	if err != nil {
+		return err
+	}
+
+	opts := cache.KeyMigrationOptions{DryRun: *dryRun, ScanCount: *scanCount}
+	var stats cache.KeyMigrationStats
+	switch args[0] {
+	case "migrate":
+		stats, err = c.MigrateKeys(ctx, opts)
+	case "purge":
+		stats, err = c.PurgeKeys(ctx, opts)
+	default:
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return fmt.Errorf("unknown cache command %q", args[0])
+	}
+
+	// partial progress is still worth knowing about
+	l.Info("finished "+args[0]+" of cache keys",
+		zap.Int("schemaVersion", cache.KeySchemaVersion),
+		zap.Bool("dryRun", *dryRun),
+		zap.Int("scanned", stats.Scanned),
+		zap.Int("outdated", stats.Outdated),
+		zap.Int("migrated", stats.Migrated),
+		zap.Int("deleted", stats.Deleted),
+	)
+	return err
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -16,12 +16,14 @@ import (
 	"github.com/censys/scan-takehome/pkg/ingester"
 	"github.com/censys/scan-takehome/pkg/ingester/cache"
 	"github.com/censys/scan-takehome/pkg/ingester/repository"
+	"github.com/censys/scan-takehome/pkg/ingester/sink"
+	"github.com/censys/scan-takehome/pkg/ingester/source"
 	"github.com/censys/scan-takehome/pkg/log"
+	"github.com/censys/scan-takehome/pkg/metrics"
+	"github.com/censys/scan-takehome/pkg/tracing"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/knadh/koanf/providers/env/v2"
 	"github.com/knadh/koanf/v2"
-	"github.com/redis/go-redis/v9"
-	"github.com/redis/go-redis/v9/maintnotifications"
 	"go.uber.org/zap"
 )
 
@@ -31,7 +33,6 @@ func main() {
 	level := k.String("log.level")
 	output := k.String("log.output")
 	projectID := k.String("projectid")
-	topicID := k.String("topicid")
 	workers := k.Int("worker.count")
 	if workers <= 0 {
 		workers = runtime.GOMAXPROCS(0)
@@ -55,58 +56,127 @@ func main() {
 		println("failed to create logger: ", err.Error())
 		os.Exit(1)
 	}
+	if len(os.Args) > 1 {
+		if err := runCommand(k, l, os.Args[1:]); err != nil {
+			l.Fatal("command failed", zap.Error(err))
+		}
+		return
+	}
+
 	l.Info("starting ingester service...")
 	ctx, fn := context.WithCancel(context.Background())
 
+	if k.Bool("metrics.enabled") {
+		go func() {
+			if err := metrics.Serve(ctx, l, k.String("metrics.addr")); err != nil {
+				l.Error("metrics server failed", zap.Error(err))
+			}
+		}()
+	}
+
+	sampleRatio := 1.0
+	if k.Exists("tracing.sample.ratio") {
+		sampleRatio = k.Float64("tracing.sample.ratio")
+	}
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		ServiceName: "ingester",
+		Exporter:    k.String("tracing.exporter"),
+		Endpoint:    k.String("tracing.endpoint"),
+		Insecure:    k.Bool("tracing.insecure"),
+		Path:        k.String("tracing.path"),
+		SampleRatio: sampleRatio,
+	})
+	if err != nil {
+		l.Fatal("failed to set up tracing", zap.Error(err))
+	}
+
 	conn, err := pgxpool.New(ctx, dbURL)
 	if err != nil {
 		l.Fatal("failed to get postgres connection", zap.Error(err))
 	}
 
-	repo := repository.NewPostgresRepository(conn)
+	// the pubsub client is shared between the source, the dead letter sink and
+	// the change events, but we only want to create it if something actually uses pubsub.
+	pubsubClient := sync.OnceValues(func() (*pubsub.Client, error) {
+		return pubsub.NewClient(ctx, projectID)
+	})
 
-	client, err := pubsub.NewClient(ctx, projectID)
-	if err != nil {
-		l.Fatal("failed to create pubsub client", zap.Error(err))
+	repoOpts := []repository.RepositoryOption{
+		repository.WithHistoryRetention(k.Duration("history.retention")),
+	}
+	if k.Bool("events.enabled") {
+		events, err := newSink[ingester.ChangeEvent](k, "events", pubsubClient)
+		if err != nil {
+			l.Fatal("failed to create change event sink", zap.Error(err))
+		}
+		defer events.Close()
+		l.Info("publishing change events", zap.String("sink", k.String("events.sink")))
+		repoOpts = append(repoOpts, repository.WithEventPublisher(sink.EventPublisher{Sink: events}))
 	}
 
-	topic := client.Topic(topicID)
+	repo := repository.NewPostgresRepository(conn, repoOpts...)
+	if retention := k.Duration("history.retention"); retention > 0 {
+		go pruneHistory(ctx, l, repo, retention)
+	}
+	if k.Bool("events.enabled") {
+		interval := k.Duration("events.relay.interval")
+		if interval <= 0 {
+			interval = time.Second * 5
+		}
+		go relayEvents(ctx, l, repo, interval)
+	}
 
-	// if we were deploying this to a k8s cluster we'd consider using something
-	// like the podUID or or the IP address of the pod. In this case we'll
-	// just use a rand. I'm not sure what docker-compose provides as an env var
-	// for unique identifiers.
-	subID := fmt.Sprintf("%s-%d", projectID, rand.Int())
-	sub, err := client.CreateSubscription(ctx, subID, pubsub.SubscriptionConfig{
-		Topic: topic,
-	})
+	ingestOpts := []ingester.IngesterOption{}
+	// also handed to the source, for sources that have to dead letter
+	// messages themselves.
+	var dlq ingester.DeadLetterer
+	if k.Bool("deadletter.enabled") {
+		letters, err := newSink[ingester.DeadLetter](k, "deadletter", pubsubClient)
+		if err != nil {
+			l.Fatal("failed to create dead letter sink", zap.Error(err))
+		}
+		defer letters.Close()
+		l.Info("dead lettering undecodable messages", zap.String("sink", k.String("deadletter.sink")))
+		dlq = sink.DeadLetterer{Sink: letters}
+		ingestOpts = append(ingestOpts, ingester.WithDeadLetter(dlq))
+	}
+
+	src, err := newSource(ctx, k, l, pubsubClient, dlq, workers)
 	if err != nil {
-		l.Fatal("failed to create pubsub subscription", zap.Error(err))
+		l.Fatal("failed to create message source", zap.Error(err))
 	}
 
-	// set the number of workers to the number of goroutines that the pubsub
-	// subscription will use. In kafka we'd have a single poller and fan out
-	// to many workers, but google likes to use callbacks and manage their own
-	// goroutines.
-	sub.ReceiveSettings.NumGoroutines = workers
+	if k.Bool("validation.enabled") {
+		ingestOpts = append(ingestOpts, ingester.WithValidator(newValidator(k)))
+		l.Info("validating scans", zap.Strings("services", stringList(k, "validation.services")))
+	}
+	if k.Bool("quarantine.enabled") {
+		quarantine, err := newSink[ingester.DeadLetter](k, "quarantine", pubsubClient)
+		if err != nil {
+			l.Fatal("failed to create quarantine sink", zap.Error(err))
+		}
+		defer quarantine.Close()
+		l.Info("quarantining invalid scans", zap.String("sink", k.String("quarantine.sink")))
+		ingestOpts = append(ingestOpts, ingester.WithQuarantine(sink.DeadLetterer{Sink: quarantine}))
+	}
 
-	ingest := ingester.NewIngester(l, sub)
+	if err := configureDataVersions(k); err != nil {
+		l.Fatal("failed to configure data versions", zap.Error(err))
+	}
+	for _, v := range ingester.SupportedVersions() {
+		l.Info("accepting data version", zap.Int("dataVersion", v.Version), zap.Stringer("status", v.Status))
+	}
 
-	var redisCache *cache.Cache
-	if k.Bool("redis.enabled") {
-		rcl := redis.NewClient(&redis.Options{
-			Addr:     k.String("redis.addr"),
-			Password: k.String("redis.password"),
-			DB:       k.Int("redis.db"),
-			// because I hate the logs that come out of this at startup
-			MaintNotificationsConfig: &maintnotifications.Config{
-				Mode: maintnotifications.ModeDisabled,
-			},
-		})
-		if _, err := rcl.Ping(ctx).Result(); err != nil {
-			l.Fatal("failed to ping with redis connection,  exiting", zap.Error(err))
-		}
-		redisCache = cache.NewCache(rcl, k.Duration("redis.ttl"))
+	ingest := ingester.NewIngester(l, src, ingestOpts...)
+
+	// stale and superseded scans skip the upsert, but still go to the history.
+	upsertOpts := []ingester.UpserterOption{ingester.WithHistory(repo)}
+	recordCache, err := newRecordCache(ctx, k, l)
+	if err != nil {
+		l.Fatal("failed to create record cache", zap.Error(err))
+	}
+	if recordCache != nil {
+		upsertOpts = append(upsertOpts, ingester.WithCache(recordCache))
 	}
 
 	var wg sync.WaitGroup
@@ -119,33 +189,362 @@ func main() {
 			repo,
 			flushInterval,
 			maxBatchSize,
-			ingester.WithCache(redisCache),
+			upsertOpts...,
 		)
 		wg.Add(1)
 		go up.Start(ctx, &wg)
 	}
 
-	go ingest.Start(ctx)
+	if warmer, ok := recordCache.(ingester.CacheWarmer); ok && k.Bool("cache.warm.enabled") {
+		warmCache(ctx, k, l, repo, warmer)
+	}
+
+	ingestDone := make(chan struct{})
+	go func() {
+		defer close(ingestDone)
+		if err := ingest.Start(ctx); err != nil {
+			l.Error("ingester stopped receiving messages", zap.Error(err))
+		}
+	}()
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	<-sigs
-
-	l.Info("shutdown signal received, finishing up....")
+	select {
+	case <-sigs:
+		l.Info("shutdown signal received, finishing up....")
+	case <-ingestDone:
+		l.Error("ingester stopped unexpectedly, shutting down")
+	}
 	fn()
 
 	shutdownCtx, fn := context.WithTimeout(context.Background(), time.Second*30)
 	defer fn()
 
-	if err = sub.Delete(shutdownCtx); err != nil {
-		l.Error("failed to delete subscription!", zap.Error(err))
+	// Receive only returns once every message it handed out has been acked or
+	// nacked, and the source can't be closed before then, or kafka would
+	// close the reader before the last offsets are committed.
+	select {
+	case <-ingestDone:
+	case <-shutdownCtx.Done():
+		l.Error("timed out waiting for in flight messages, closing the source anyway")
+	}
+	if err = src.Close(shutdownCtx); err != nil {
+		l.Error("failed to close message source!", zap.Error(err))
 	}
 
 	wg.Wait()
 
+	// the relay stopped with the context, send on whatever the last flushes
+	// left in the outbox. Anything that doesn't make it goes out on the next
+	// start.
+	if k.Bool("events.enabled") {
+		if _, err = repo.PublishOutbox(shutdownCtx); err != nil {
+			l.Error("failed to publish change events", zap.Error(err))
+		}
+	}
+
+	// after the upserters are done so the last flush makes it out.
+	if err = shutdownTracing(shutdownCtx); err != nil {
+		l.Error("failed to flush traces", zap.Error(err))
+	}
+
 	l.Info("goodbye!")
 }
 
+// pruneHistory drops scan history partitions older than the retention period,
+// once at startup and then every hour until the context is done.
+func pruneHistory(ctx context.Context, l *zap.Logger, repo *repository.PostgresRespository, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		dropped, err := repo.PruneHistory(ctx, retention)
+		if err != nil {
+			l.Error("failed to prune scan history", zap.Error(err))
+		} else if dropped > 0 {
+			l.Info("pruned scan history partitions", zap.Int("count", dropped))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayEvents publishes the change events upserts leave in the outbox. Upserts
+// wake it up as soon as they commit, and it checks every interval as well for
+// anything left by a failed publish or another replica.
+func relayEvents(ctx context.Context, l *zap.Logger, repo *repository.PostgresRespository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		published, err := repo.PublishOutbox(ctx)
+		if err != nil && ctx.Err() == nil {
+			l.Error("failed to publish change events", zap.Error(err))
+		} else if published > 0 {
+			l.Debug("published change events", zap.Int("count", published))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-repo.OutboxReady():
+		case <-ticker.C:
+		}
+	}
+}
+
+// newSource builds the message source the ingester will listen on, based on
+// the source.type config value. Defaults to pubsub.
+func newSource(
+	ctx context.Context,
+	k *koanf.Koanf,
+	l *zap.Logger,
+	pubsubClient func() (*pubsub.Client, error),
+	dlq ingester.DeadLetterer,
+	workers int,
+) (ingester.Source, error) {
+	switch sourceType := k.String("source.type"); sourceType {
+	case "", "pubsub":
+		client, err := pubsubClient()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pubsub client: %w", err)
+		}
+		topic := client.Topic(k.String("topicid"))
+
+		// a stable subscription lets replicas share the work, and keeps any
+		// messages published while we're down or restarting.
+		subID := k.String("subscription.id")
+		if subID == "" {
+			subID = fmt.Sprintf("%s-ingester", k.String("topicid"))
+		}
+		subCfg := source.SubscriptionConfig{
+			ID:                  subID,
+			Topic:               topic,
+			AckDeadline:         k.Duration("subscription.ack.deadline"),
+			RetentionDuration:   k.Duration("subscription.retention"),
+			MaxDeliveryAttempts: k.Int("subscription.deadletter.max.attempts"),
+			Filter:              strings.Join(stringList(k, "subscription.filter"), " "),
+		}
+		if dlqTopic := k.String("subscription.deadletter.topicid"); dlqTopic != "" {
+			subCfg.DeadLetterTopic = client.Topic(dlqTopic)
+		}
+		sub, err := source.EnsureSubscription(ctx, l, client, subCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		// set the number of workers to the number of goroutines that the pubsub
+		// subscription will use. In kafka we'd have a single poller and fan out
+		// to many workers, but google likes to use callbacks and manage their own
+		// goroutines.
+		sub.ReceiveSettings.NumGoroutines = workers
+		l.Info("listening on pubsub subscription", zap.String("subscription", subID))
+
+		var opts []source.PubSubOption
+		if k.Bool("subscription.delete.on.shutdown") {
+			opts = append(opts, source.WithDeleteOnClose())
+		}
+		return source.NewPubSubSource(sub, opts...), nil
+	case "kafka":
+		cfg := source.KafkaConfig{
+			Brokers:             stringList(k, "kafka.brokers"),
+			Topic:               k.String("kafka.topic"),
+			GroupID:             k.String("kafka.group.id"),
+			MaxInFlight:         k.Int("kafka.max.in.flight"),
+			CommitInterval:      k.Duration("kafka.commit.interval"),
+			RetryBackoff:        k.Duration("kafka.retry.backoff"),
+			MaxDeliveryAttempts: k.Int("kafka.max.delivery.attempts"),
+			DeadLetter:          dlq,
+		}
+		if cfg.MaxInFlight <= 0 {
+			// enough to keep every upserter busy with a full batch
+			cfg.MaxInFlight = workers * k.Int("max.batch.size")
+		}
+		l.Info("listening on kafka topic",
+			zap.Strings("brokers", cfg.Brokers),
+			zap.String("topic", cfg.Topic),
+			zap.String("groupID", cfg.GroupID),
+		)
+		return source.NewKafkaSource(l, cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown source type %q", sourceType)
+	}
+}
+
+// newSink builds the sink configured under prefix, which is used for the dead
+// letter, quarantine and change event sinks. The sink should be closed on
+// shutdown to flush and release it.
+func newSink[T sink.Message](k *koanf.Koanf, prefix string, pubsubClient func() (*pubsub.Client, error)) (sink.Sink[T], error) {
+	switch kind := k.String(prefix + ".sink"); kind {
+	case "", "pubsub":
+		client, err := pubsubClient()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pubsub client: %w", err)
+		}
+		return sink.NewPubSub[T](client.Topic(k.String(prefix + ".topicid"))), nil
+	case "file":
+		fs, err := sink.NewFile[T](k.String(prefix + ".path"))
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	default:
+		return nil, fmt.Errorf("unknown %s sink %q", prefix, kind)
+	}
+}
+
+// warmCache loads what's already in postgres into the cache. Consuming waits
+// for it until the deadline, after which the warm up carries on in the
+// background alongside live traffic.
+func warmCache(ctx context.Context, k *koanf.Koanf, l *zap.Logger, repo *repository.PostgresRespository, warmer ingester.CacheWarmer) {
+	opts := ingester.WarmOptions{
+		Query:     ingester.LastSeenQuery{Limit: k.Int("cache.warm.limit")},
+		BatchSize: k.Int("cache.warm.batch.size"),
+	}
+	if window := k.Duration("cache.warm.window"); window > 0 {
+		opts.Query.Since = time.Now().Add(-window)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// errors are already logged, and the cache works fine cold.
+		_, _ = ingester.WarmCache(ctx, l, repo, warmer, opts)
+	}()
+
+	deadline := time.NewTimer(k.Duration("cache.warm.deadline"))
+	defer deadline.Stop()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	case <-deadline.C:
+		l.Warn("cache warm up passed its deadline, consuming while it finishes in the background")
+	}
+}
+
+// newRecordCache builds the cache from config. With both enabled, the memory
+// cache sits in front of redis. With neither, there's no cache and ordering is
+// left to the database.
+func newRecordCache(ctx context.Context, k *koanf.Koanf, l *zap.Logger) (ingester.RecordCache, error) {
+	var memory *cache.MemoryCache
+	if k.Bool("cache.memory.enabled") {
+		memory = cache.NewMemoryCache(
+			cache.WithTTL(k.Duration("cache.memory.ttl")),
+			cache.WithMaxEntries(k.Int("cache.memory.max.entries")),
+			cache.WithMaxBytes(k.Int64("cache.memory.max.bytes")),
+		)
+	}
+
+	if !k.Bool("redis.enabled") {
+		if memory == nil {
+			return nil, nil
+		}
+		l.Info("using in memory record cache")
+		return memory, nil
+	}
+
+	opts := []cache.CacheOption{}
+	if memory != nil {
+		l.Info("using in memory record cache in front of redis")
+		opts = append(opts, cache.WithL1(memory))
+	}
+	return newRedisCache(ctx, k, opts...)
+}
+
+// newRedisCache connects to redis and builds the cache on top of it.
+func newRedisCache(ctx context.Context, k *koanf.Koanf, opts ...cache.CacheOption) (*cache.Cache, error) {
+	addrs := stringList(k, "redis.addrs")
+	if len(addrs) == 0 {
+		addrs = stringList(k, "redis.addr")
+	}
+	rcl, err := cache.NewClient(cache.ClientConfig{
+		Addrs:            addrs,
+		Username:         k.String("redis.username"),
+		Password:         k.String("redis.password"),
+		DB:               k.Int("redis.db"),
+		Cluster:          k.Bool("redis.cluster"),
+		MasterName:       k.String("redis.master.name"),
+		SentinelUsername: k.String("redis.sentinel.username"),
+		SentinelPassword: k.String("redis.sentinel.password"),
+		RouteByLatency:   k.Bool("redis.route.by.latency"),
+		TLS: cache.TLSConfig{
+			Enabled:            k.Bool("redis.tls.enabled"),
+			CAFile:             k.String("redis.tls.ca.file"),
+			CertFile:           k.String("redis.tls.cert.file"),
+			KeyFile:            k.String("redis.tls.key.file"),
+			ServerName:         k.String("redis.tls.server.name"),
+			InsecureSkipVerify: k.Bool("redis.tls.insecure.skip.verify"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rcl.Ping(ctx).Result(); err != nil {
+		return nil, fmt.Errorf("failed to ping redis: %w", err)
+	}
+	if k.Exists("redis.key.prefix") {
+		opts = append(opts, cache.WithKeyPrefix(k.String("redis.key.prefix")))
+	}
+	return cache.NewCache(rcl, k.Duration("redis.ttl"), opts...), nil
+}
+
+// newValidator builds the scan validator from config. Durations left at zero
+// keep the validator's defaults.
+func newValidator(k *koanf.Koanf) *ingester.Validator {
+	opts := []ingester.ValidatorOption{}
+	if services := stringList(k, "validation.services"); len(services) > 0 {
+		opts = append(opts, ingester.WithAllowedServices(services...))
+	}
+	if skew := k.Duration("validation.max.clock.skew"); skew > 0 {
+		opts = append(opts, ingester.WithMaxClockSkew(skew))
+	}
+	if age := k.Duration("validation.max.age"); age > 0 {
+		opts = append(opts, ingester.WithMaxAge(age))
+	}
+	if k.Bool("validation.allow.private") {
+		opts = append(opts, ingester.WithAllowPrivate())
+	}
+	return ingester.NewValidator(opts...)
+}
+
+// configureDataVersions disables or deprecates the data versions listed in
+// config. Anything not listed stays enabled.
+func configureDataVersions(k *koanf.Koanf) error {
+	// deprecated goes first, so a version in both ends up disabled.
+	for _, c := range []struct {
+		path   string
+		status ingester.DataVersionStatus
+	}{
+		{path: "data.versions.deprecated", status: ingester.DataVersionDeprecated},
+		{path: "data.versions.disabled", status: ingester.DataVersionDisabled},
+	} {
+		for _, v := range stringList(k, c.path) {
+			version, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("bad data version %q in %s: %w", v, c.path, err)
+			}
+			if err := ingester.SetDataVersionStatus(version, c.status); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stringList reads a space separated config value. The env transform only
+// splits values that contain a space, so a single value needs a little help.
+func stringList(k *koanf.Koanf, path string) []string {
+	if v := k.Strings(path); len(v) > 0 {
+		return v
+	}
+	if v := k.String(path); v != "" {
+		return []string{v}
+	}
+	return nil
+}
+
 func loadConfigValues(k *koanf.Koanf) {
 	prefix := "INGESTER_"
 	k.Load(env.Provider(".", env.Opt{
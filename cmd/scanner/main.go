@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/pubsub"
@@ -14,11 +18,29 @@ import (
 
 var (
 	services = []string{"HTTP", "SSH", "DNS"}
+	// the transports each service can be found on.
+	transports = map[string][]string{
+		"HTTP": {scanning.TransportTCP, scanning.TransportQUIC},
+		"SSH":  {scanning.TransportTCP},
+		"DNS":  {scanning.TransportUDP, scanning.TransportTCP},
+	}
 )
 
 func main() {
 	projectId := flag.String("project", "test-project", "GCP Project ID")
 	topicId := flag.String("topic", "scan-topic", "GCP PubSub Topic ID")
+	versionList := flag.String("versions", "1,2,3", "comma separated data versions to pick from")
+	ipv6 := flag.Float64("ipv6", 0.25, "share of scans, 0 to 1, sent for ipv6 targets")
+	flag.Parse()
+
+	var versions []int
+	for _, v := range strings.Split(*versionList, ",") {
+		version, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			panic(fmt.Sprintf("bad data version %q", v))
+		}
+		versions = append(versions, version)
+	}
 
 	ctx := context.Background()
 
@@ -32,20 +54,25 @@ func main() {
 	for range time.Tick(time.Second) {
 
 		scan := &scanning.Scan{
-			Ip:        fmt.Sprintf("1.1.1.%d", rand.Intn(255)),
-			Port:      uint32(rand.Intn(65535)),
+			Ip:        randomIP(*ipv6),
+			Port:      uint32(1 + rand.Intn(65535)),
 			Service:   services[rand.Intn(len(services))],
 			Timestamp: time.Now().Unix(),
 		}
+		scan.Transport = transports[scan.Service][rand.Intn(len(transports[scan.Service]))]
 
 		serviceResp := fmt.Sprintf("service response: %d", rand.Intn(100))
 
-		if rand.Intn(2) == 0 {
-			scan.DataVersion = scanning.V1
+		scan.DataVersion = versions[rand.Intn(len(versions))]
+		switch scan.DataVersion {
+		case scanning.V1:
 			scan.Data = &scanning.V1Data{ResponseBytesUtf8: []byte(serviceResp)}
-		} else {
-			scan.DataVersion = scanning.V2
+		case scanning.V2:
 			scan.Data = &scanning.V2Data{ResponseStr: serviceResp}
+		case scanning.V3:
+			scan.Data = v3Data(scan.Service, serviceResp)
+		default:
+			panic(fmt.Sprintf("unknown data version %d", scan.DataVersion))
 		}
 
 		encoded, err := json.Marshal(scan)
@@ -59,3 +86,61 @@ func main() {
 		}
 	}
 }
+
+// v3Data makes up a plausible protocol section for the service to go along
+// with the response.
+func v3Data(service, resp string) *scanning.V3Data {
+	data := &scanning.V3Data{ResponseStr: resp}
+	switch service {
+	case "HTTP":
+		body := fmt.Sprintf("<html><title>%s</title></html>", resp)
+		sum := sha256.Sum256([]byte(body))
+		data.HTTP = &scanning.HTTPData{
+			StatusCode: []int{200, 301, 404, 500}[rand.Intn(4)],
+			Headers: map[string][]string{
+				"Server":       {[]string{"nginx", "Apache", "caddy"}[rand.Intn(3)]},
+				"Content-Type": {"text/html"},
+			},
+			Title:      resp,
+			BodySHA256: hex.EncodeToString(sum[:]),
+		}
+	case "SSH":
+		data.SSH = &scanning.SSHData{
+			Banner:            fmt.Sprintf("SSH-2.0-OpenSSH_9.%d", rand.Intn(10)),
+			KexAlgorithms:     []string{"curve25519-sha256", "diffie-hellman-group14-sha256"},
+			HostKeyAlgorithms: []string{"ssh-ed25519", "rsa-sha2-512"},
+		}
+	case "DNS":
+		data.DNS = &scanning.DNSData{
+			Answers: []scanning.DNSAnswer{{
+				Name: "example.com.",
+				Type: "A",
+				TTL:  uint32(rand.Intn(3600)),
+				Data: fmt.Sprintf("93.184.216.%d", rand.Intn(255)),
+			}},
+		}
+	}
+	return data
+}
+
+// randomIP picks an ipv4 target, or an ipv6 one with the given probability.
+// The same address is written a few different ways, like real scanners
+// would, so the ingester has to work out they're the same host.
+func randomIP(ipv6 float64) string {
+	if rand.Float64() >= ipv6 {
+		if rand.Intn(10) == 0 {
+			return fmt.Sprintf("::ffff:1.1.1.%d", rand.Intn(255))
+		}
+		return fmt.Sprintf("1.1.1.%d", rand.Intn(255))
+	}
+
+	host := rand.Intn(255)
+	switch rand.Intn(3) {
+	case 0:
+		return fmt.Sprintf("2606:4700:4700:0000:0000:0000:0000:%04X", host)
+	case 1:
+		return fmt.Sprintf("2606:4700:4700:0:0:0:0:%x", host)
+	default:
+		return fmt.Sprintf("2606:4700:4700::%x", host)
+	}
+}
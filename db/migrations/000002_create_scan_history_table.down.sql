@@ -0,0 +1 @@
+DROP TABLE IF EXISTS scan_history;
\ No newline at end of file
@@ -0,0 +1,12 @@
+-- every observation that made it past the ingester, not just the latest one.
+-- Partitioned by month on observed_at so old data can be dropped cheaply.
+-- Partitions are created by the ingester as data for a new month shows up.
+CREATE TABLE IF NOT EXISTS scan_history(
+    ip INET NOT NULL,
+    port INT NOT NULL,
+    service TEXT NOT NULL,
+    response TEXT NOT NULL,
+    observed_at TIMESTAMP NOT NULL,
+    recorded_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+    CONSTRAINT scan_history_observation UNIQUE(ip, port, service, observed_at)
+) PARTITION BY RANGE (observed_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS scan_results_ip_gist_idx;
+DROP INDEX IF EXISTS scan_results_port_idx;
+DROP INDEX IF EXISTS scan_results_service_idx;
+DROP INDEX IF EXISTS scan_results_last_seen_idx;
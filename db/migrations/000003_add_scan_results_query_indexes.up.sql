@@ -0,0 +1,6 @@
+-- network searches (ip <<= '1.1.1.0/24') need a gist index. The btree behind
+-- the ip_port_service constraint only helps with exact ip lookups.
+CREATE INDEX IF NOT EXISTS scan_results_ip_gist_idx ON scan_results USING GIST (ip inet_ops);
+CREATE INDEX IF NOT EXISTS scan_results_port_idx ON scan_results (port);
+CREATE INDEX IF NOT EXISTS scan_results_service_idx ON scan_results (service);
+CREATE INDEX IF NOT EXISTS scan_results_last_seen_idx ON scan_results (last_seen);
@@ -0,0 +1,2 @@
+ALTER TABLE scan_results DROP COLUMN IF EXISTS protocol;
+ALTER TABLE scan_history DROP COLUMN IF EXISTS protocol;
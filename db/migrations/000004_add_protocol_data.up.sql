@@ -0,0 +1,5 @@
+-- the structured, per protocol part of a scan (http status and headers, ssh
+-- banner, dns answers...). Only newer data versions send it, so it's null for
+-- everything else.
+ALTER TABLE scan_results ADD COLUMN IF NOT EXISTS protocol JSONB;
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS protocol JSONB;
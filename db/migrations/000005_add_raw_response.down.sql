@@ -0,0 +1,4 @@
+ALTER TABLE scan_results DROP COLUMN IF EXISTS response_raw;
+ALTER TABLE scan_results DROP COLUMN IF EXISTS response_valid_utf8;
+ALTER TABLE scan_history DROP COLUMN IF EXISTS response_raw;
+ALTER TABLE scan_history DROP COLUMN IF EXISTS response_valid_utf8;
@@ -0,0 +1,11 @@
+-- response is now the sanitized text, safe for display. The response exactly
+-- as it was sent, which may be binary or in some other charset, is kept in
+-- response_raw, and response_valid_utf8 records whether it was valid utf-8.
+-- Anything already saved made it into a TEXT column, so it was valid.
+ALTER TABLE scan_results ADD COLUMN IF NOT EXISTS response_raw BYTEA;
+ALTER TABLE scan_results ADD COLUMN IF NOT EXISTS response_valid_utf8 BOOLEAN NOT NULL DEFAULT true;
+UPDATE scan_results SET response_raw = convert_to(response, 'UTF8') WHERE response_raw IS NULL;
+
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS response_raw BYTEA;
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS response_valid_utf8 BOOLEAN NOT NULL DEFAULT true;
+UPDATE scan_history SET response_raw = convert_to(response, 'UTF8') WHERE response_raw IS NULL;
@@ -0,0 +1,2 @@
+-- nothing to undo, plain ipv4 is what the mapped addresses should have been.
+SELECT 1;
@@ -0,0 +1,31 @@
+-- ipv4 addresses used to be sent as ipv4 mapped ipv6 (::ffff:1.1.1.1), which
+-- postgres treats as a different address to 1.1.1.1 and leaves out of ipv4
+-- network searches. Rewrite them as plain ipv4. Where both spellings already
+-- have a row, the newest scan wins.
+DELETE FROM scan_results AS mapped
+USING scan_results AS plain
+WHERE mapped.ip <<= '::ffff:0.0.0.0/96'
+    AND plain.ip = substr(host(mapped.ip), 8)::inet
+    AND plain.port = mapped.port
+    AND plain.service = mapped.service
+    AND plain.last_seen >= mapped.last_seen;
+
+DELETE FROM scan_results AS plain
+USING scan_results AS mapped
+WHERE mapped.ip <<= '::ffff:0.0.0.0/96'
+    AND plain.ip = substr(host(mapped.ip), 8)::inet
+    AND plain.port = mapped.port
+    AND plain.service = mapped.service;
+
+UPDATE scan_results SET ip = substr(host(ip), 8)::inet WHERE ip <<= '::ffff:0.0.0.0/96';
+
+-- the same observation under both spellings is a redelivery, keep one.
+DELETE FROM scan_history AS mapped
+USING scan_history AS plain
+WHERE mapped.ip <<= '::ffff:0.0.0.0/96'
+    AND plain.ip = substr(host(mapped.ip), 8)::inet
+    AND plain.port = mapped.port
+    AND plain.service = mapped.service
+    AND plain.observed_at = mapped.observed_at;
+
+UPDATE scan_history SET ip = substr(host(ip), 8)::inet WHERE ip <<= '::ffff:0.0.0.0/96';
@@ -0,0 +1,10 @@
+-- only the tcp rows fit the old constraints, anything else has to go.
+DELETE FROM scan_results WHERE transport <> 'tcp';
+ALTER TABLE scan_results DROP CONSTRAINT IF EXISTS ip_port_transport_service;
+ALTER TABLE scan_results ADD CONSTRAINT ip_port_service UNIQUE(ip, port, service);
+ALTER TABLE scan_results DROP COLUMN IF EXISTS transport;
+
+DELETE FROM scan_history WHERE transport <> 'tcp';
+ALTER TABLE scan_history DROP CONSTRAINT IF EXISTS scan_history_observation;
+ALTER TABLE scan_history ADD CONSTRAINT scan_history_observation UNIQUE(ip, port, service, observed_at);
+ALTER TABLE scan_history DROP COLUMN IF EXISTS transport;
@@ -0,0 +1,10 @@
+-- the same port can run a service over more than one transport, eg DNS on
+-- udp/53 and tcp/53, so the transport is part of what identifies a service.
+-- Everything saved so far came from scanners that only scanned over tcp.
+ALTER TABLE scan_results ADD COLUMN IF NOT EXISTS transport TEXT NOT NULL DEFAULT 'tcp';
+ALTER TABLE scan_results DROP CONSTRAINT IF EXISTS ip_port_service;
+ALTER TABLE scan_results ADD CONSTRAINT ip_port_transport_service UNIQUE(ip, port, transport, service);
+
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS transport TEXT NOT NULL DEFAULT 'tcp';
+ALTER TABLE scan_history DROP CONSTRAINT IF EXISTS scan_history_observation;
+ALTER TABLE scan_history ADD CONSTRAINT scan_history_observation UNIQUE(ip, port, transport, service, observed_at);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS scan_results_last_changed_idx;
+ALTER TABLE scan_results DROP COLUMN IF EXISTS response_hash;
+ALTER TABLE scan_results DROP COLUMN IF EXISTS first_seen;
+ALTER TABLE scan_results DROP COLUMN IF EXISTS last_changed;
+ALTER TABLE scan_results DROP COLUMN IF EXISTS seen_count;
@@ -0,0 +1,33 @@
+-- response_hash lets the upsert tell a service that changed apart from one
+-- that was simply seen again. first_seen, last_changed and seen_count track
+-- the rest of that story.
+ALTER TABLE scan_results ADD COLUMN IF NOT EXISTS response_hash BYTEA;
+ALTER TABLE scan_results ADD COLUMN IF NOT EXISTS first_seen TIMESTAMP;
+ALTER TABLE scan_results ADD COLUMN IF NOT EXISTS last_changed TIMESTAMP;
+ALTER TABLE scan_results ADD COLUMN IF NOT EXISTS seen_count BIGINT NOT NULL DEFAULT 1;
+
+-- there's no telling when a row saved before now last changed, so it's the
+-- last time it was seen. The history knows a little more about the rest, as
+-- far back as it hasn't been pruned. response_hash is the sha256 of the raw
+-- response and nothing else, the same as the ingester's responseHash.
+UPDATE scan_results SET
+    response_hash = sha256(COALESCE(response_raw, convert_to(response, 'UTF8'))),
+    first_seen = last_seen,
+    last_changed = last_seen
+WHERE response_hash IS NULL;
+
+UPDATE scan_results AS r SET
+    first_seen = LEAST(r.first_seen, h.first_seen),
+    seen_count = GREATEST(h.seen_count, 1)
+FROM (
+    SELECT ip, port, transport, service, min(observed_at) AS first_seen, count(*) AS seen_count
+    FROM scan_history
+    GROUP BY ip, port, transport, service
+) AS h
+WHERE r.ip = h.ip AND r.port = h.port AND r.transport = h.transport AND r.service = h.service;
+
+ALTER TABLE scan_results ALTER COLUMN response_hash SET NOT NULL;
+ALTER TABLE scan_results ALTER COLUMN first_seen SET NOT NULL;
+ALTER TABLE scan_results ALTER COLUMN last_changed SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS scan_results_last_changed_idx ON scan_results (last_changed);
@@ -0,0 +1,9 @@
+-- change events waiting to be published. They're written in the same
+-- transaction as the upsert that produced them, so there's only ever an event
+-- for a change that was saved, and deleted once the publisher has them.
+-- uuidv7 ids sort in the order the events were written.
+CREATE TABLE IF NOT EXISTS change_event_outbox(
+    id UUID PRIMARY KEY DEFAULT uuidv7(),
+    event JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc')
+);
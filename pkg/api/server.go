@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester/repository"
+	"go.uber.org/zap"
+)
+
+// ScanReader is the read side of the repository that the API needs.
+type ScanReader interface {
+	SearchScanResults(ctx context.Context, q repository.ScanResultQuery) ([]repository.ScanResult, error)
+}
+
+// Page is a single page of results. NextCursor is empty on the last page.
+type Page struct {
+	Results    []repository.ScanResult `json:"results"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server serves read only queries over the scan results as json.
+type Server struct {
+	l               *zap.Logger
+	reader          ScanReader
+	mux             *http.ServeMux
+	defaultPageSize int
+	maxPageSize     int
+}
+
+// ServerOption provides additional configuration for the [Server]
+type ServerOption func(*Server)
+
+// WithPageSize sets the page size used when a request doesn't ask for one,
+// and the largest page size a request may ask for.
+func WithPageSize(defaultSize, maxSize int) ServerOption {
+	return func(s *Server) {
+		s.defaultPageSize = defaultSize
+		s.maxPageSize = maxSize
+	}
+}
+
+// NewServer creates a new API server backed by the provided reader
+func NewServer(l *zap.Logger, reader ScanReader, opts ...ServerOption) *Server {
+	s := &Server{
+		l:               l,
+		reader:          reader,
+		mux:             http.NewServeMux(),
+		defaultPageSize: 100,
+		maxPageSize:     1000,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.mux.HandleFunc("GET /healthz", s.healthz)
+	s.mux.HandleFunc("GET /v1/scans", s.searchScans)
+	s.mux.HandleFunc("GET /v1/hosts/{ip}", s.getHost)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) healthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// searchScans handles GET /v1/scans. Supported query params are ip, cidr,
+// port, transport, service, seen_after, seen_before, changed_after (RFC3339),
+// limit and cursor.
+func (s *Server) searchScans(w http.ResponseWriter, r *http.Request) {
+	q, err := s.parseQuery(r)
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	s.search(w, r, q)
+}
+
+// getHost handles GET /v1/hosts/{ip}, returning every service seen on the
+// host. Takes the same query params as /v1/scans, minus ip and cidr.
+func (s *Server) getHost(w http.ResponseWriter, r *http.Request) {
+	addr, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid ip"})
+		return
+	}
+	q, err := s.parseQuery(r)
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	q.Ip = addr.String()
+	q.Network = netip.Prefix{}
+	s.search(w, r, q)
+}
+
+// search runs the query and writes a page of results. One extra row is
+// fetched to find out if there is another page.
+func (s *Server) search(w http.ResponseWriter, r *http.Request, q repository.ScanResultQuery) {
+	pageSize := q.Limit
+	q.Limit = pageSize + 1
+
+	results, err := s.reader.SearchScanResults(r.Context(), q)
+	if err != nil {
+		s.l.Error("failed to search scan results", zap.Error(err))
+		s.writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to search scan results"})
+		return
+	}
+
+	page := Page{Results: results}
+	if len(results) > pageSize {
+		page.Results = results[:pageSize]
+		page.NextCursor = encodeCursor(page.Results[pageSize-1].ID)
+	}
+	if page.Results == nil {
+		page.Results = []repository.ScanResult{}
+	}
+	s.writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) parseQuery(r *http.Request) (repository.ScanResultQuery, error) {
+	params := r.URL.Query()
+	q := repository.ScanResultQuery{
+		Transport: strings.ToLower(params.Get("transport")),
+		Service:   params.Get("service"),
+		Limit:     s.defaultPageSize,
+	}
+
+	if v := params.Get("ip"); v != "" {
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return q, errors.New("invalid ip")
+		}
+		q.Ip = addr.String()
+	}
+	if v := params.Get("cidr"); v != "" {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return q, errors.New("invalid cidr")
+		}
+		q.Network = prefix
+	}
+	if v := params.Get("port"); v != "" {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || port == 0 {
+			return q, errors.New("port must be between 1 and 65535")
+		}
+		q.Port = uint32(port)
+	}
+	for name, dst := range map[string]*time.Time{
+		"seen_after":    &q.SeenAfter,
+		"seen_before":   &q.SeenBefore,
+		"changed_after": &q.ChangedAfter,
+	} {
+		v := params.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("%s must be an RFC3339 timestamp", name)
+		}
+		*dst = t
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > s.maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", s.maxPageSize)
+		}
+		q.Limit = limit
+	}
+	if v := params.Get("cursor"); v != "" {
+		after, err := decodeCursor(v)
+		if err != nil {
+			return q, errors.New("invalid cursor")
+		}
+		q.After = after
+	}
+	return q, nil
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.l.Error("failed to write response", zap.Error(err))
+	}
+}
+
+// cursors are opaque to clients so we're free to change what's in them.
+func encodeCursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", err
+	}
+	id := string(b)
+	if !isUUID(id) {
+		return "", errors.New("cursor is not a uuid")
+	}
+	return id, nil
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
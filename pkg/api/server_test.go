@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester/repository"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSearchScans(t *testing.T) {
+	seenAfter := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		url            string
+		expectedStatus int
+		expectedQuery  repository.ScanResultQuery
+	}{
+		{
+			name:           "defaults",
+			url:            "/v1/scans",
+			expectedStatus: http.StatusOK,
+			expectedQuery:  repository.ScanResultQuery{Limit: 3},
+		},
+		{
+			name:           "every filter",
+			url:            "/v1/scans?cidr=1.1.1.0/24&port=53&transport=UDP&service=DNS&seen_after=2025-01-01T00:00:00Z&changed_after=2025-01-01T00:00:00Z&limit=2",
+			expectedStatus: http.StatusOK,
+			expectedQuery: repository.ScanResultQuery{
+				Network:      netip.MustParsePrefix("1.1.1.0/24"),
+				Port:         53,
+				Transport:    "udp",
+				Service:      "DNS",
+				SeenAfter:    seenAfter,
+				ChangedAfter: seenAfter,
+				Limit:        3,
+			},
+		},
+		{
+			name:           "host lookup",
+			url:            "/v1/hosts/1.1.1.1",
+			expectedStatus: http.StatusOK,
+			expectedQuery:  repository.ScanResultQuery{Ip: "1.1.1.1", Limit: 3},
+		},
+		{
+			name:           "cursor is decoded",
+			url:            "/v1/scans?cursor=" + encodeCursor("0199f0a4-4a5e-7000-8000-000000000000"),
+			expectedStatus: http.StatusOK,
+			expectedQuery:  repository.ScanResultQuery{After: "0199f0a4-4a5e-7000-8000-000000000000", Limit: 3},
+		},
+		{name: "bad ip", url: "/v1/scans?ip=1.1.1", expectedStatus: http.StatusBadRequest},
+		{name: "bad host", url: "/v1/hosts/nope", expectedStatus: http.StatusBadRequest},
+		{name: "bad cidr", url: "/v1/scans?cidr=1.1.1.0/33", expectedStatus: http.StatusBadRequest},
+		{name: "bad port", url: "/v1/scans?port=70000", expectedStatus: http.StatusBadRequest},
+		{name: "zero port", url: "/v1/scans?port=0", expectedStatus: http.StatusBadRequest},
+		{name: "bad time", url: "/v1/scans?seen_before=yesterday", expectedStatus: http.StatusBadRequest},
+		{name: "limit too large", url: "/v1/scans?limit=11", expectedStatus: http.StatusBadRequest},
+		{name: "bad cursor", url: "/v1/scans?cursor=" + encodeCursor("1 OR 1=1"), expectedStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &mockReader{}
+			subject := NewServer(zaptest.NewLogger(t), reader, WithPageSize(2, 10))
+
+			rec := httptest.NewRecorder()
+			subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			if tt.expectedStatus == http.StatusOK {
+				assert.Equal(t, []repository.ScanResultQuery{tt.expectedQuery}, reader.queries)
+			} else {
+				assert.Empty(t, reader.queries)
+			}
+		})
+	}
+}
+
+func TestSearchScansPagination(t *testing.T) {
+	reader := &mockReader{results: makeResults(5)}
+	subject := NewServer(zaptest.NewLogger(t), reader, WithPageSize(2, 10))
+
+	var ids []string
+	url := "/v1/scans"
+	for range 5 {
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var page Page
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		for _, res := range page.Results {
+			ids = append(ids, res.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		url = "/v1/scans?cursor=" + page.NextCursor
+	}
+
+	expected := []string{}
+	for _, res := range makeResults(5) {
+		expected = append(expected, res.ID)
+	}
+	assert.Equal(t, expected, ids)
+	assert.Len(t, reader.queries, 3)
+}
+
+func TestSearchScansReaderError(t *testing.T) {
+	reader := &mockReader{err: errors.New("test-error")}
+	subject := NewServer(zaptest.NewLogger(t), reader)
+
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/scans", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "test-error", "internal errors should not leak to clients")
+}
+
+func makeResults(count int) []repository.ScanResult {
+	results := []repository.ScanResult{}
+	for i := range count {
+		results = append(results, repository.ScanResult{
+			ID:       fmt.Sprintf("0199f0a4-4a5e-7000-8000-%012d", i),
+			Ip:       "1.1.1.1",
+			Port:     uint32(80 + i),
+			Service:  "HTTP",
+			Response: "test-response",
+			LastSeen: time.Now().UTC(),
+		})
+	}
+	return results
+}
+
+// mockReader pages through results the same way the repository does, by ID.
+type mockReader struct {
+	err     error
+	results []repository.ScanResult
+	queries []repository.ScanResultQuery
+}
+
+func (m *mockReader) SearchScanResults(_ context.Context, q repository.ScanResultQuery) ([]repository.ScanResult, error) {
+	m.queries = append(m.queries, q)
+	if m.err != nil {
+		return nil, m.err
+	}
+	var out []repository.ScanResult
+	for _, res := range m.results {
+		if res.ID > q.After && len(out) < q.Limit {
+			out = append(out, res)
+		}
+	}
+	return out, nil
+}
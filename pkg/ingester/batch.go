@@ -0,0 +1,33 @@
+package ingester
+
+// batch holds the messages waiting to be flushed, keyed on the identity of the
+// scan. Postgres won't let a single upsert touch the same row twice, so only
+// the newest scan for each key is kept.
+type batch map[string]*messageRequest
+
+// add puts the message into the batch. If a message for the same key is
+// already waiting, the older of the two is returned so the caller can answer
+// it. Ties go to the message that got here first.
+func (b batch) add(msg *messageRequest) (superseded *messageRequest) {
+	key := msg.scan.Key()
+	existing, ok := b[key]
+	if !ok {
+		b[key] = msg
+		return nil
+	}
+
+	if msg.scan.Timestamp > existing.scan.Timestamp {
+		b[key] = msg
+		return existing
+	}
+	return msg
+}
+
+// messages returns every message in the batch, in no particular order.
+func (b batch) messages() []*messageRequest {
+	msgs := make([]*messageRequest, 0, len(b))
+	for _, msg := range b {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
@@ -0,0 +1,29 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchAdd(t *testing.T) {
+	scans := makeMessages(2)
+	first := &messageRequest{scan: scans[0]}
+	other := &messageRequest{scan: scans[1]}
+
+	newerScan := scans[0]
+	newerScan.Timestamp += 10
+	newer := &messageRequest{scan: newerScan}
+
+	sameTime := &messageRequest{scan: newerScan}
+
+	b := batch{}
+	assert.Nil(t, b.add(first))
+	assert.Nil(t, b.add(other))
+	assert.Same(t, first, b.add(newer), "the older waiting message should be superseded")
+	assert.Same(t, sameTime, b.add(sameTime), "ties should keep the message already in the batch")
+	assert.Same(t, first, b.add(first), "older incoming messages should be superseded")
+	assert.Len(t, b, 2)
+	assert.Same(t, newer, b[scans[0].Key()])
+	assert.ElementsMatch(t, []*messageRequest{newer, other}, b.messages())
+}
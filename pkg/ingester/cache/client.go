@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/redis/go-redis/v9/maintnotifications"
+)
+
+// ClientConfig describes how to connect to redis. The topology comes from
+// what's set: a master name means sentinel, more than one address (or Cluster)
+// means cluster, and anything else is a single node.
+type ClientConfig struct {
+	Addrs    []string
+	Username string
+	Password string
+	// DB is ignored in cluster mode, which only has db 0.
+	DB int
+	// Cluster forces cluster mode with a single address, for configuration
+	// endpoints like the ones elasticache hands out.
+	Cluster bool
+	// MasterName is the name of the sentinel master. When it's set Addrs are
+	// the sentinels, not the redis nodes.
+	MasterName       string
+	SentinelUsername string
+	SentinelPassword string
+	// RouteByLatency sends read only commands to the closest node. With
+	// sentinel this reads from replicas too.
+	RouteByLatency bool
+	TLS            TLSConfig
+}
+
+// TLSConfig is the TLS setup for the redis connection.
+type TLSConfig struct {
+	Enabled bool
+	// CAFile verifies the server with a private CA instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile are a client certificate, for mutual TLS.
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// NewClient creates the redis client for the configured topology.
+func NewClient(cfg ClientConfig) (redis.UniversalClient, error) {
+	if len(cfg.Addrs) == 0 {
+		return nil, errors.New("at least one redis address is required")
+	}
+	tlsConfig, err := cfg.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	return redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:            cfg.Addrs,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		DB:               cfg.DB,
+		IsClusterMode:    cfg.Cluster,
+		MasterName:       cfg.MasterName,
+		SentinelUsername: cfg.SentinelUsername,
+		SentinelPassword: cfg.SentinelPassword,
+		RouteByLatency:   cfg.RouteByLatency,
+		TLSConfig:        tlsConfig,
+		// because I hate the logs that come out of this at startup
+		MaintNotificationsConfig: &maintnotifications.Config{
+			Mode: maintnotifications.ModeDisabled,
+		},
+	}), nil
+}
+
+func (c TLSConfig) config() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read redis ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in redis ca %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load redis client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClientTopology(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         ClientConfig
+		expectedErr bool
+		cluster     bool
+	}{
+		{name: "no addresses", expectedErr: true},
+		{name: "single node", cfg: ClientConfig{Addrs: []string{"localhost:6379"}}},
+		{name: "cluster from addresses", cfg: ClientConfig{Addrs: []string{"localhost:7000", "localhost:7001"}}, cluster: true},
+		{name: "cluster from a config endpoint", cfg: ClientConfig{Addrs: []string{"localhost:7000"}, Cluster: true}, cluster: true},
+		{name: "sentinel", cfg: ClientConfig{Addrs: []string{"localhost:26379", "localhost:26380"}, MasterName: "mymaster"}},
+		{
+			name:    "sentinel reading from replicas",
+			cfg:     ClientConfig{Addrs: []string{"localhost:26379"}, MasterName: "mymaster", RouteByLatency: true},
+			cluster: true,
+		},
+		{name: "bad ca", cfg: ClientConfig{Addrs: []string{"localhost:6379"}, TLS: TLSConfig{Enabled: true, CAFile: "nope.pem"}}, expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcl, err := NewClient(tt.cfg)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer rcl.Close()
+			_, isCluster := rcl.(*redis.ClusterClient)
+			assert.Equal(t, tt.cluster, isCluster)
+		})
+	}
+}
+
+func TestNewClientTLS(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(notPEM, []byte("not a cert"), 0o600))
+
+	_, err := NewClient(ClientConfig{Addrs: []string{"localhost:6379"}, TLS: TLSConfig{Enabled: true, CAFile: notPEM}})
+	assert.Error(t, err)
+	_, err = NewClient(ClientConfig{Addrs: []string{"localhost:6379"}, TLS: TLSConfig{Enabled: true, CertFile: notPEM, KeyFile: notPEM}})
+	assert.Error(t, err)
+
+	rcl, err := NewClient(ClientConfig{Addrs: []string{"localhost:6379"}, TLS: TLSConfig{Enabled: true, ServerName: "redis.internal"}})
+	assert.NoError(t, err)
+	defer rcl.Close()
+	if client, ok := rcl.(*redis.Client); assert.True(t, ok) && assert.NotNil(t, client.Options().TLSConfig) {
+		assert.Equal(t, "redis.internal", client.Options().TLSConfig.ServerName)
+	}
+}
+
+// Run the batch operations through a cluster client, which splits pipelines
+// up by slot and loads scripts on every node.
+func TestCacheInClusterMode(t *testing.T) {
+	s := miniredis.RunT(t)
+	rcl, err := NewClient(ClientConfig{Addrs: []string{s.Addr()}, Cluster: true})
+	assert.NoError(t, err)
+	defer rcl.Close()
+	subject := NewCache(rcl, time.Hour)
+	ctx := context.Background()
+
+	records := []ingester.Scan{makeScan("1.1.1.1"), makeScan("2.2.2.2"), makeScan("3.3.3.3")}
+	checks, err := subject.CheckRecords(ctx, records)
+	assert.NoError(t, err)
+	assert.Len(t, checks, 3)
+	restored, err := subject.RestoreRecords(ctx, []ingester.RecordRestore{{Record: records[0]}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), restored)
+	assert.NoError(t, subject.WarmRecords(ctx, records))
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/censys/scan-takehome/pkg/scanning"
+)
+
+// KeySchemaVersion is embedded in every cache key. Bump it whenever the
+// layout of a key, or what goes into it, changes, so keys written by an older
+// ingester are never mistaken for current ones. Keys from an older schema can
+// be moved over with [Cache.MigrateKeys] or dropped with [Cache.PurgeKeys].
+const KeySchemaVersion = 2
+
+// DefaultKeyPrefix namespaces the keys so they don't collide with anything
+// else living in the same redis database.
+const DefaultKeyPrefix = "ingester"
+
+// keyFromRecord is the part of the key that identifies a record:
+//
+//	v2:{1.1.1.1}:53:udp:DNS
+//
+// The ip is hash tagged, so in cluster mode every key for a host lands in the
+// same slot and batch operations over a host's keys (multi key commands,
+// scripts, transactions) don't get rejected as cross slot. The braces also
+// keep the colons in an ipv6 address from being confused with the separators.
+//
+// This is also the key used by the memory cache, which doesn't need a prefix.
+func keyFromRecord(record ingester.Scan) string {
+	return fmt.Sprintf("v%d:{%s}:%d:%s:%s", KeySchemaVersion,
+		ingester.CanonicalIP(record.Ip), record.Port, ingester.NormalizeTransport(record.Transport), record.Service)
+}
+
+// key puts the prefix on the record key.
+func (c *Cache) key(id string) string {
+	if c.prefix == "" {
+		return id
+	}
+	return c.prefix + ":" + id
+}
+
+// parseKey works out which record a key in redis belongs to, and the schema
+// version it was written with. Keys from before the schema was versioned are
+// version 0, either as ip-port-service or with the ip hash tagged. Version 1
+// keys don't have a transport. Scans were all tcp back then, as they are for
+// version 0. Anything that isn't one of our keys is not ok, so it's left
+// alone.
+func (c *Cache) parseKey(key string) (ingester.Scan, int, bool) {
+	rest := key
+	if c.prefix != "" {
+		var ok bool
+		if rest, ok = strings.CutPrefix(key, c.prefix+":"); !ok {
+			return parseUnversionedKey(key)
+		}
+	}
+
+	versioned, ok := strings.CutPrefix(rest, "v")
+	if !ok {
+		return parseUnversionedKey(key)
+	}
+	v, id, ok := strings.Cut(versioned, ":")
+	if !ok {
+		return ingester.Scan{}, 0, false
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version <= 0 {
+		return ingester.Scan{}, 0, false
+	}
+	ip, id, ok := cutHashTag(id)
+	if !ok {
+		return ingester.Scan{}, 0, false
+	}
+	id, ok = strings.CutPrefix(id, ":")
+	if !ok {
+		return ingester.Scan{}, 0, false
+	}
+	port, service, ok := strings.Cut(id, ":")
+	if !ok {
+		return ingester.Scan{}, 0, false
+	}
+	transport := scanning.TransportTCP
+	if version >= 2 {
+		if transport, service, ok = strings.Cut(service, ":"); !ok {
+			return ingester.Scan{}, 0, false
+		}
+	}
+	record, ok := recordFromParts(ip, port, transport, service)
+	return record, version, ok
+}
+
+// parseUnversionedKey parses the version 0 keys, {ip}-port-service or
+// ip-port-service.
+func parseUnversionedKey(key string) (ingester.Scan, int, bool) {
+	var ip, rest string
+	var ok bool
+	if strings.HasPrefix(key, "{") {
+		if ip, rest, ok = cutHashTag(key); ok {
+			rest, ok = strings.CutPrefix(rest, "-")
+		}
+	} else {
+		ip, rest, ok = strings.Cut(key, "-")
+	}
+	if !ok {
+		return ingester.Scan{}, 0, false
+	}
+	port, service, ok := strings.Cut(rest, "-")
+	if !ok {
+		return ingester.Scan{}, 0, false
+	}
+	record, ok := recordFromParts(ip, port, scanning.TransportTCP, service)
+	return record, 0, ok
+}
+
+// cutHashTag splits {ip}rest into the ip and the rest.
+func cutHashTag(s string) (string, string, bool) {
+	s, ok := strings.CutPrefix(s, "{")
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(s, "}")
+}
+
+// recordFromParts is strict about what it accepts, since a key that only
+// looks like one of ours could belong to anyone.
+func recordFromParts(ip, port, transport, service string) (ingester.Scan, bool) {
+	if _, err := netip.ParseAddr(ip); err != nil || transport == "" || service == "" {
+		return ingester.Scan{}, false
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return ingester.Scan{}, false
+	}
+	var record ingester.Scan
+	record.Ip = ip
+	record.Port = uint32(p)
+	record.Transport = transport
+	record.Service = service
+	return record, true
+}
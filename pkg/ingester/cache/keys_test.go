@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		ip        string
+		transport string
+		opts      []CacheOption
+		expected  string
+	}{
+		{name: "default prefix", ip: "1.1.1.1", expected: "ingester:v2:{1.1.1.1}:53:tcp:DNS"},
+		{name: "custom prefix", ip: "1.1.1.1", opts: []CacheOption{WithKeyPrefix("scans")}, expected: "scans:v2:{1.1.1.1}:53:tcp:DNS"},
+		{name: "no prefix", ip: "1.1.1.1", opts: []CacheOption{WithKeyPrefix("")}, expected: "v2:{1.1.1.1}:53:tcp:DNS"},
+		{name: "ipv4 mapped", ip: "::ffff:1.1.1.1", expected: "ingester:v2:{1.1.1.1}:53:tcp:DNS"},
+		{name: "ipv6 is compressed", ip: "2001:0DB8:0000:0000:0000:0000:0000:0001", expected: "ingester:v2:{2001:db8::1}:53:tcp:DNS"},
+		{name: "not an ip", ip: "localhost", expected: "ingester:v2:{localhost}:53:tcp:DNS"},
+		{name: "udp", ip: "1.1.1.1", transport: "udp", expected: "ingester:v2:{1.1.1.1}:53:udp:DNS"},
+		{name: "transport is lower cased", ip: "1.1.1.1", transport: "UDP", expected: "ingester:v2:{1.1.1.1}:53:udp:DNS"},
+	}
+	for _, tt := range tests {
+		subject := NewCache(nil, time.Hour, tt.opts...)
+		record := makeScan(tt.ip)
+		record.Transport = tt.transport
+		assert.Equal(t, tt.expected, subject.key(keyFromRecord(record)), tt.name)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	subject := NewCache(nil, time.Hour)
+	tests := []struct {
+		key       string
+		ok        bool
+		version   int
+		ip        string
+		port      uint32
+		transport string
+		service   string
+	}{
+		{key: "ingester:v2:{1.1.1.1}:53:udp:DNS", ok: true, version: 2, ip: "1.1.1.1", port: 53, transport: "udp", service: "DNS"},
+		{key: "ingester:v2:{2001:db8::1}:443:quic:HTTP", ok: true, version: 2, ip: "2001:db8::1", port: 443, transport: "quic", service: "HTTP"},
+		{key: "ingester:v7:{1.1.1.1}:53:udp:DNS", ok: true, version: 7, ip: "1.1.1.1", port: 53, transport: "udp", service: "DNS"},
+		{key: "ingester:v1:{1.1.1.1}:53:DNS", ok: true, version: 1, ip: "1.1.1.1", port: 53, transport: "tcp", service: "DNS"},
+		{key: "ingester:v1:{2001:db8::1}:443:HTTP", ok: true, version: 1, ip: "2001:db8::1", port: 443, transport: "tcp", service: "HTTP"},
+		{key: "{1.1.1.1}-53-DNS", ok: true, ip: "1.1.1.1", port: 53, transport: "tcp", service: "DNS"},
+		{key: "1.1.1.1-53-DNS", ok: true, ip: "1.1.1.1", port: 53, transport: "tcp", service: "DNS"},
+		{key: "1.1.1.1-53-SOME-SERVICE", ok: true, ip: "1.1.1.1", port: 53, transport: "tcp", service: "SOME-SERVICE"},
+		{key: "ingester:v2:{1.1.1.1}:53:DNS"},
+		{key: "ingester:v2:{1.1.1.1}:53::DNS"},
+		{key: "other:v1:{1.1.1.1}:53:DNS"},
+		{key: "ingester:v1:1.1.1.1:53:DNS"},
+		{key: "ingester:v0:{1.1.1.1}:53:DNS"},
+		{key: "ingester:vx:{1.1.1.1}:53:DNS"},
+		{key: "ingester:v1:{1.1.1.1}:99999:DNS"},
+		{key: "session-1234-abcd"},
+		{key: "{1.1.1.1}53-DNS"},
+		{key: "1.1.1.1-53-"},
+		{key: "1.1.1.1"},
+	}
+	for _, tt := range tests {
+		record, version, ok := subject.parseKey(tt.key)
+		assert.Equal(t, tt.ok, ok, tt.key)
+		if !tt.ok {
+			continue
+		}
+		assert.Equal(t, tt.version, version, tt.key)
+		assert.Equal(t, tt.ip, record.Ip, tt.key)
+		assert.Equal(t, tt.port, record.Port, tt.key)
+		assert.Equal(t, tt.transport, record.Transport, tt.key)
+		assert.Equal(t, tt.service, record.Service, tt.key)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	s := miniredis.RunT(t)
+	subject := NewCache(redis.NewClient(&redis.Options{Addr: s.Addr()}), time.Hour)
+	ctx := context.Background()
+
+	s.Set("1.1.1.1-53-DNS", "100")
+	s.Set("{2.2.2.2}-53-DNS", "100")
+	s.Set("{3.3.3.3}-53-DNS", "not-a-timestamp")
+	// already has something newer under the current schema.
+	s.Set("::ffff:4.4.4.4-53-DNS", "100")
+	current := subject.key(keyFromRecord(makeScan("4.4.4.4")))
+	s.Set(current, "200")
+	s.Set("ingester:v1:{6.6.6.6}:53:DNS", "100")
+	s.Set("ingester:v3:{5.5.5.5}:53:tcp:DNS", "100")
+	s.Set("session-1234-abcd", "keep me")
+
+	stats, err := subject.MigrateKeys(ctx, KeyMigrationOptions{DryRun: true, ScanCount: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, KeyMigrationStats{Scanned: 8, Outdated: 5}, stats)
+	assert.True(t, s.Exists("1.1.1.1-53-DNS"), "a dry run shouldn't change anything")
+
+	// keys written while the scan is running may or may not be seen by it, so
+	// what was scanned isn't exact. Unlike redis, miniredis can also skip keys
+	// that were there all along when others are deleted mid scan, so this one
+	// is done in a single batch.
+	stats, err = subject.MigrateKeys(ctx, KeyMigrationOptions{ScanCount: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, stats.Outdated)
+	assert.Equal(t, 4, stats.Migrated)
+	assert.Equal(t, 5, stats.Deleted)
+
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "6.6.6.6"} {
+		cached, err := s.Get(subject.key(keyFromRecord(makeScan(ip))))
+		assert.NoError(t, err, ip)
+		assert.Equal(t, "100", cached, ip)
+		assert.Equal(t, time.Hour, s.TTL(subject.key(keyFromRecord(makeScan(ip)))), ip)
+	}
+	assert.False(t, s.Exists(subject.key(keyFromRecord(makeScan("3.3.3.3")))), "garbage shouldn't be migrated")
+	cached, err := s.Get(current)
+	assert.NoError(t, err)
+	assert.Equal(t, "200", cached, "migrating shouldn't move a key backwards")
+	assert.ElementsMatch(t, []string{
+		subject.key(keyFromRecord(makeScan("1.1.1.1"))),
+		subject.key(keyFromRecord(makeScan("2.2.2.2"))),
+		subject.key(keyFromRecord(makeScan("6.6.6.6"))),
+		current,
+		"ingester:v3:{5.5.5.5}:53:tcp:DNS",
+		"session-1234-abcd",
+	}, s.Keys())
+}
+
+func TestPurgeKeys(t *testing.T) {
+	s := miniredis.RunT(t)
+	rcl, err := NewClient(ClientConfig{Addrs: []string{s.Addr()}, Cluster: true})
+	assert.NoError(t, err)
+	defer rcl.Close()
+	subject := NewCache(rcl, time.Hour)
+	ctx := context.Background()
+
+	_, err = subject.CheckRecord(ctx, makeScan("1.1.1.1"))
+	assert.NoError(t, err)
+	s.Set("{2.2.2.2}-53-DNS", "100")
+	s.Set("session-1234-abcd", "keep me")
+
+	stats, err := subject.PurgeKeys(ctx, KeyMigrationOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, KeyMigrationStats{Scanned: 3, Outdated: 1, Deleted: 1}, stats)
+	assert.ElementsMatch(t, []string{subject.key(keyFromRecord(makeScan("1.1.1.1"))), "session-1234-abcd"}, s.Keys())
+}
+
+// In cluster mode only the part of the key between the braces is hashed, so
+// every key for a host lands in the same slot.
+func TestKeysAreHashTaggedByHost(t *testing.T) {
+	dns := makeScan("1.1.1.1")
+	http := dns
+	http.Port = 80
+	http.Service = "HTTP"
+
+	assert.Equal(t, "v2:{1.1.1.1}:53:tcp:DNS", keyFromRecord(dns))
+	assert.Equal(t, "v2:{1.1.1.1}:80:tcp:HTTP", keyFromRecord(http))
+}
@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+)
+
+// DefaultMaxEntries is the entry limit used when a [MemoryCache] isn't given
+// any limits, so it can't grow forever.
+const DefaultMaxEntries = 100_000
+
+// entryOverhead is a rough guess at what an entry costs on top of its key: the
+// list element, the map bucket, the timestamps. It doesn't need to be exact,
+// just close enough that a byte limit means something.
+const entryOverhead = 96
+
+// MemoryCache is an in process, least recently used cache of the newest
+// timestamp seen for each record. It's safe for use by multiple upserters.
+// Nothing is shared between replicas, so on its own it only dedupes what a
+// single ingester sees.
+type MemoryCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	bytes      int64
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	now        func() time.Time
+}
+
+type memoryEntry struct {
+	key       string
+	timestamp int64
+	expires   time.Time
+}
+
+// MemoryOption provides additional configuration for the [MemoryCache]
+type MemoryOption func(*MemoryCache)
+
+// WithTTL expires entries that haven't been updated in d. Zero never expires.
+func WithTTL(d time.Duration) MemoryOption {
+	return func(c *MemoryCache) {
+		c.ttl = d
+	}
+}
+
+// WithMaxEntries caps the number of keys kept. Zero is no limit.
+func WithMaxEntries(n int) MemoryOption {
+	return func(c *MemoryCache) {
+		c.maxEntries = n
+	}
+}
+
+// WithMaxBytes caps the approximate memory used by the entries. Zero is no
+// limit.
+func WithMaxBytes(n int64) MemoryOption {
+	return func(c *MemoryCache) {
+		c.maxBytes = n
+	}
+}
+
+// NewMemoryCache creates a new in memory cache. If neither a max entries nor
+// max bytes limit is set, [DefaultMaxEntries] is used.
+func NewMemoryCache(opts ...MemoryOption) *MemoryCache {
+	c := &MemoryCache{
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		now:     time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.maxEntries <= 0 && c.maxBytes <= 0 {
+		c.maxEntries = DefaultMaxEntries
+	}
+	return c
+}
+
+// CheckRecord compares the scan with the newest one seen for the same key and
+// keeps whichever is newer.
+func (c *MemoryCache) CheckRecord(_ context.Context, record ingester.Scan) (ingester.RecordStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.check(keyFromRecord(record), record.Timestamp).Status, nil
+}
+
+// CheckRecords checks the whole batch while holding the lock once.
+func (c *MemoryCache) CheckRecords(_ context.Context, records []ingester.Scan) ([]ingester.RecordCheck, error) {
+	checks := make([]ingester.RecordCheck, len(records))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, record := range records {
+		checks[i] = c.check(keyFromRecord(record), record.Timestamp)
+	}
+	return checks, nil
+}
+
+// RestoreRecords puts back the previous timestamps for keys that haven't
+// moved on since they were checked.
+func (c *MemoryCache) RestoreRecords(_ context.Context, restores []ingester.RecordRestore) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var restored int64
+	for _, r := range restores {
+		if c.restore(keyFromRecord(r.Record), r.Record.Timestamp, r.Previous) {
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// WarmRecords seeds the cache with scans that are already saved. Timestamps
+// only ever move forward, so it's safe to run alongside live traffic.
+func (c *MemoryCache) WarmRecords(_ context.Context, records []ingester.Scan) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, record := range records {
+		c.setNewer(keyFromRecord(record), record.Timestamp)
+	}
+	return nil
+}
+
+// check must be called with the lock held.
+func (c *MemoryCache) check(key string, timestamp int64) ingester.RecordCheck {
+	cached, ok := c.get(key)
+	if ok && cached >= timestamp {
+		lookups.WithLabelValues(tierMemory, "stale").Inc()
+		return ingester.RecordCheck{Status: ingester.RecordStale}
+	}
+	c.set(key, timestamp)
+	if !ok {
+		lookups.WithLabelValues(tierMemory, "miss").Inc()
+		return ingester.RecordCheck{Status: ingester.RecordNew}
+	}
+	lookups.WithLabelValues(tierMemory, "hit").Inc()
+	return ingester.RecordCheck{Status: ingester.RecordNewer, Previous: cached}
+}
+
+// restore must be called with the lock held.
+func (c *MemoryCache) restore(key string, timestamp, previous int64) bool {
+	el, ok := c.entries[key]
+	if !ok || el.Value.(*memoryEntry).timestamp != timestamp {
+		return false
+	}
+	if previous == 0 {
+		c.remove(el)
+	} else {
+		c.set(key, previous)
+	}
+	return true
+}
+
+// Len is the number of entries in the cache, including any that have expired
+// but haven't been looked at since.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// lookup returns the cached timestamp for the key, for when we're sitting in
+// front of redis.
+func (c *MemoryCache) lookup(key string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key)
+}
+
+// observe records that something at least as new as timestamp exists for the
+// key, without ever moving the cached timestamp backwards.
+func (c *MemoryCache) observe(key string, timestamp int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setNewer(key, timestamp)
+}
+
+// restoreKey is [RestoreRecords] for a single key, for when we're sitting in
+// front of redis.
+func (c *MemoryCache) restoreKey(key string, timestamp, previous int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.restore(key, timestamp, previous)
+}
+
+// get must be called with the lock held.
+func (c *MemoryCache) get(key string) (int64, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	entry := el.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && !c.now().Before(entry.expires) {
+		c.remove(el)
+		return 0, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.timestamp, true
+}
+
+// setNewer must be called with the lock held.
+func (c *MemoryCache) setNewer(key string, timestamp int64) {
+	if cached, ok := c.get(key); ok && cached >= timestamp {
+		return
+	}
+	c.set(key, timestamp)
+}
+
+// set must be called with the lock held.
+func (c *MemoryCache) set(key string, timestamp int64) {
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = c.now().Add(c.ttl)
+	}
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*memoryEntry)
+		entry.timestamp = timestamp
+		entry.expires = expires
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&memoryEntry{key: key, timestamp: timestamp, expires: expires})
+	c.bytes += entrySize(key)
+	for c.overLimit() {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *MemoryCache) overLimit() bool {
+	if c.lru.Len() <= 1 {
+		// always keep the entry we just added, even if it's huge.
+		return false
+	}
+	return (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) ||
+		(c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+func (c *MemoryCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*memoryEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entrySize(entry.key)
+}
+
+func entrySize(key string) int64 {
+	return int64(len(key)) + entryOverhead
+}
@@ -0,0 +1,254 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/censys/scan-takehome/pkg/ingester/source"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMemoryCache(t *testing.T) {
+	subject := NewMemoryCache()
+	ctx := context.Background()
+
+	tests := []struct {
+		timestamp int64
+		expected  ingester.RecordStatus
+	}{
+		{timestamp: 100, expected: ingester.RecordNew},
+		{timestamp: 50, expected: ingester.RecordStale},
+		{timestamp: 100, expected: ingester.RecordStale},
+		{timestamp: 200, expected: ingester.RecordNewer},
+		{timestamp: 150, expected: ingester.RecordStale},
+	}
+	for _, tt := range tests {
+		status, err := subject.CheckRecord(ctx, makeMessage(tt.timestamp))
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, status, "timestamp %d", tt.timestamp)
+	}
+
+}
+
+func TestMemoryCacheRestoreRecords(t *testing.T) {
+	subject := NewMemoryCache()
+	ctx := context.Background()
+
+	checks, err := subject.CheckRecords(ctx, []ingester.Scan{makeMessage(100), makeScan("2.2.2.2"), makeScan("3.3.3.3")})
+	assert.NoError(t, err)
+	checks, err = subject.CheckRecords(ctx, []ingester.Scan{makeMessage(200)})
+	assert.NoError(t, err)
+	assert.Equal(t, []ingester.RecordCheck{{Status: ingester.RecordNewer, Previous: 100}}, checks)
+	// someone else moves 3.3.3.3 along before we restore
+	moved := makeScan("3.3.3.3")
+	moved.Timestamp += 10
+	subject.CheckRecord(ctx, moved)
+
+	restored, err := subject.RestoreRecords(ctx, []ingester.RecordRestore{
+		{Record: makeMessage(200), Previous: 100},
+		{Record: makeScan("2.2.2.2")},
+		{Record: makeScan("3.3.3.3")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), restored)
+
+	cached, _ := subject.lookup(keyFromRecord(makeMessage(0)))
+	assert.Equal(t, int64(100), cached, "the previous value should be put back")
+	_, ok := subject.lookup(keyFromRecord(makeScan("2.2.2.2")))
+	assert.False(t, ok, "keys that didn't exist before should be removed")
+	cached, _ = subject.lookup(keyFromRecord(moved))
+	assert.Equal(t, moved.Timestamp, cached, "newer values shouldn't be touched")
+}
+
+func TestMemoryCacheCheckRecords(t *testing.T) {
+	subject := NewMemoryCache()
+	ctx := context.Background()
+	first := makeScan("1.1.1.1")
+	older := first
+	older.Timestamp--
+
+	// duplicates in the same batch are checked in order.
+	checks, err := subject.CheckRecords(ctx, []ingester.Scan{first, makeScan("2.2.2.2"), older})
+	assert.NoError(t, err)
+	assert.Equal(t, []ingester.RecordCheck{
+		{Status: ingester.RecordNew},
+		{Status: ingester.RecordNew},
+		{Status: ingester.RecordStale},
+	}, checks)
+}
+
+func TestMemoryCacheWarmRecords(t *testing.T) {
+	subject := NewMemoryCache()
+	ctx := context.Background()
+	subject.CheckRecord(ctx, makeMessage(200))
+
+	assert.NoError(t, subject.WarmRecords(ctx, []ingester.Scan{makeMessage(100), makeScan("2.2.2.2")}))
+	cached, _ := subject.lookup(keyFromRecord(makeMessage(0)))
+	assert.Equal(t, int64(200), cached, "warming shouldn't move a key backwards")
+	status, _ := subject.CheckRecord(ctx, makeScan("2.2.2.2"))
+	assert.Equal(t, ingester.RecordStale, status)
+}
+
+func TestMemoryCacheTTL(t *testing.T) {
+	now := time.Now()
+	subject := NewMemoryCache(WithTTL(time.Minute))
+	subject.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	subject.CheckRecord(ctx, makeMessage(100))
+	now = now.Add(time.Second * 59)
+	status, _ := subject.CheckRecord(ctx, makeMessage(50))
+	assert.Equal(t, ingester.RecordStale, status)
+
+	now = now.Add(time.Minute)
+	status, _ = subject.CheckRecord(ctx, makeMessage(50))
+	assert.Equal(t, ingester.RecordNew, status, "expired entries should be forgotten")
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	t.Run("max entries evicts least recently used", func(t *testing.T) {
+		subject := NewMemoryCache(WithMaxEntries(2))
+		subject.CheckRecord(ctx, makeScan("1.1.1.1"))
+		subject.CheckRecord(ctx, makeScan("2.2.2.2"))
+		// touch the first so the second is the oldest
+		subject.CheckRecord(ctx, makeScan("1.1.1.1"))
+		subject.CheckRecord(ctx, makeScan("3.3.3.3"))
+
+		assert.Equal(t, 2, subject.Len())
+		_, ok := subject.lookup(keyFromRecord(makeScan("2.2.2.2")))
+		assert.False(t, ok)
+		_, ok = subject.lookup(keyFromRecord(makeScan("1.1.1.1")))
+		assert.True(t, ok)
+	})
+	t.Run("max bytes", func(t *testing.T) {
+		size := entrySize(keyFromRecord(makeScan("1.1.1.1")))
+		subject := NewMemoryCache(WithMaxBytes(size * 3))
+		for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5"} {
+			subject.CheckRecord(ctx, makeScan(ip))
+		}
+		assert.Equal(t, 3, subject.Len())
+		assert.LessOrEqual(t, subject.bytes, size*3)
+	})
+	t.Run("no limits uses the default", func(t *testing.T) {
+		assert.Equal(t, DefaultMaxEntries, NewMemoryCache().maxEntries)
+	})
+}
+
+func TestMemoryCacheConcurrentWriters(t *testing.T) {
+	subject := NewMemoryCache(WithMaxEntries(10))
+	workers := 16
+	perWorker := 200
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counts := map[ingester.RecordStatus]int{}
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				status, err := subject.CheckRecord(context.Background(), makeMessage(int64(i*workers+w)))
+				assert.NoError(t, err)
+				mu.Lock()
+				counts[status]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	cached, ok := subject.lookup(keyFromRecord(makeMessage(0)))
+	assert.True(t, ok)
+	assert.Equal(t, int64(workers*perWorker-1), cached)
+	assert.Equal(t, 1, counts[ingester.RecordNew])
+}
+
+func makeScan(ip string) ingester.Scan {
+	scan := makeMessage(time.Now().Unix())
+	scan.Ip = ip
+	return scan
+}
+
+// Warming is only worth it if what it loads keeps older scans out of the
+// upsert.
+func TestWarmedCacheKeepsStaleScansOutOfTheUpsert(t *testing.T) {
+	subject := NewMemoryCache()
+	saved := makeScan("1.1.1.1")
+	loaded, err := ingester.WarmCache(context.Background(), zaptest.NewLogger(t), lastSeen{saved}, subject, ingester.WarmOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loaded)
+	older := saved
+	older.Timestamp -= 60
+
+	upserted := upsertThroughCache(t, subject, older, makeScan("2.2.2.2"))
+	assert.Equal(t, []string{"2.2.2.2"}, ips(upserted))
+}
+
+// lastSeen streams its scans as the saved ones.
+type lastSeen []ingester.Scan
+
+func (ls lastSeen) StreamLastSeen(_ context.Context, _ ingester.LastSeenQuery, f func(ingester.Scan) error) error {
+	for _, scan := range ls {
+		if err := f(scan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsertThroughCache runs the scans through an ingester and an upserter using
+// the cache, one flush per scan, and returns what was handed to UpsertMany.
+// Every scan has to be acked either way.
+func upsertThroughCache(t *testing.T, c ingester.RecordCache, scans ...ingester.Scan) []ingester.Scan {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	l := zaptest.NewLogger(t)
+	src := source.NewMemorySource(len(scans))
+	repo := &mockRepo{}
+	ingest := ingester.NewIngester(l, src)
+	// a batch size of zero flushes after every message.
+	up := ingester.NewUpserter(l, ingest.SendChan, repo, time.Hour, 0, ingester.WithCache(c))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go up.Start(ctx, &wg)
+	go ingest.Start(ctx)
+	for _, scan := range scans {
+		data, err := json.Marshal(scan.Scan)
+		assert.NoError(t, err)
+		handle, err := src.Publish(ctx, data)
+		assert.NoError(t, err)
+		select {
+		case <-handle.Done():
+			assert.True(t, handle.Acked(), scan.Ip)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the scan to be answered")
+		}
+	}
+	fn()
+	wg.Wait()
+	return repo.res
+}
+
+type mockRepo struct {
+	res []ingester.Scan
+}
+
+func (m *mockRepo) UpsertMany(_ context.Context, scans []ingester.Scan) (ingester.UpsertStats, error) {
+	m.res = append(m.res, scans...)
+	return ingester.UpsertStats{New: len(scans)}, nil
+}
+
+func ips(scans []ingester.Scan) []string {
+	out := []string{}
+	for _, scan := range scans {
+		out = append(out, scan.Ip)
+	}
+	return out
+}
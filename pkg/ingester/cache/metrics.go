@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"github.com/censys/scan-takehome/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cache tiers, used as the tier label on lookups.
+const (
+	tierMemory = "memory"
+	tierRedis  = "redis"
+)
+
+var (
+	// lookups counts the results of CheckRecord. A miss is a key we've never
+	// seen, a hit is a key we have seen with an older timestamp, and stale is a
+	// scan that is no newer than what we already have. The tier is whichever
+	// cache gave the answer.
+	lookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "cache",
+		Name:      "lookups_total",
+		Help:      "Cache lookups by tier (memory or redis) and result: hit, miss or stale.",
+	}, []string{"tier", "result"})
+
+	cacheErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "cache",
+		Name:      "errors_total",
+		Help:      "Errors talking to the cache, by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	metrics.MustRegister(lookups, cacheErrors)
+}
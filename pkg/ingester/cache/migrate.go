@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyMigrationOptions controls a run of [Cache.MigrateKeys] or
+// [Cache.PurgeKeys].
+type KeyMigrationOptions struct {
+	// DryRun only counts the outdated keys, without changing anything.
+	DryRun bool
+	// ScanCount is the COUNT hint given to SCAN, roughly how many keys are
+	// looked at per round trip. Defaults to 1000.
+	ScanCount int64
+}
+
+// KeyMigrationStats is what a migration or purge got up to.
+type KeyMigrationStats struct {
+	// Scanned is every key looked at, ours or not.
+	Scanned int
+	// Outdated is the keys written with an older schema.
+	Outdated int
+	// Migrated is the outdated keys copied to the current schema.
+	Migrated int
+	// Deleted is the outdated keys removed.
+	Deleted int
+}
+
+// MigrateKeys moves every key written with an older schema over to the
+// current one, then deletes the old key. The move goes through the same
+// compare and set as [Cache.CheckRecord], so it's safe to run alongside live
+// traffic and never moves a current key backwards. Migrated keys start over
+// with the full ttl. Keys with a different prefix, or from a newer schema, are
+// left alone.
+func (c *Cache) MigrateKeys(ctx context.Context, opts KeyMigrationOptions) (KeyMigrationStats, error) {
+	return c.rewriteKeys(ctx, opts, true)
+}
+
+// PurgeKeys deletes every key written with an older schema. It's the quicker
+// option when the cache can just be warmed up again.
+func (c *Cache) PurgeKeys(ctx context.Context, opts KeyMigrationOptions) (KeyMigrationStats, error) {
+	return c.rewriteKeys(ctx, opts, false)
+}
+
+func (c *Cache) rewriteKeys(ctx context.Context, opts KeyMigrationOptions, migrate bool) (KeyMigrationStats, error) {
+	if opts.ScanCount <= 0 {
+		opts.ScanCount = 1000
+	}
+	var mu sync.Mutex
+	var stats KeyMigrationStats
+	err := c.scanKeys(ctx, opts.ScanCount, func(keys []string) error {
+		batch, err := c.rewriteBatch(ctx, keys, opts.DryRun, migrate)
+		mu.Lock()
+		defer mu.Unlock()
+		stats.Scanned += batch.Scanned
+		stats.Outdated += batch.Outdated
+		stats.Migrated += batch.Migrated
+		stats.Deleted += batch.Deleted
+		return err
+	})
+	return stats, err
+}
+
+// scanKeys hands every key in redis to f, a page at a time. SCAN only covers
+// the node it's sent to, so in cluster mode every master is scanned, which
+// means f can be called concurrently.
+func (c *Cache) scanKeys(ctx context.Context, count int64, f func([]string) error) error {
+	if cluster, ok := c.rcl.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scanNode(ctx, node, count, f)
+		})
+	}
+	return scanNode(ctx, c.rcl, count, f)
+}
+
+func scanNode(ctx context.Context, rcl redis.Cmdable, count int64, f func([]string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := rcl.Scan(ctx, cursor, "", count).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := f(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// rewriteBatch migrates (or just deletes) the outdated keys in a page of scan
+// results. Every command is sent on its own, since the old and new keys for a
+// record don't necessarily share a slot.
+func (c *Cache) rewriteBatch(ctx context.Context, keys []string, dryRun, migrate bool) (KeyMigrationStats, error) {
+	stats := KeyMigrationStats{Scanned: len(keys)}
+	var outdated []string
+	var records []ingester.Scan
+	for _, key := range keys {
+		record, version, ok := c.parseKey(key)
+		if !ok || version >= KeySchemaVersion {
+			continue
+		}
+		outdated = append(outdated, key)
+		records = append(records, record)
+	}
+	stats.Outdated = len(outdated)
+	if len(outdated) == 0 || dryRun {
+		return stats, nil
+	}
+
+	if migrate {
+		migrated, err := c.copyKeys(ctx, outdated, records)
+		stats.Migrated = migrated
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	cmds, err := c.rcl.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range outdated {
+			pipe.Del(ctx, key)
+		}
+		return nil
+	})
+	for _, cmd := range cmds {
+		if n, err := cmd.(*redis.IntCmd).Result(); err == nil {
+			stats.Deleted += int(n)
+		}
+	}
+	return stats, err
+}
+
+// copyKeys writes the timestamps held by the old keys to the current keys for
+// the records, returning how many were copied.
+func (c *Cache) copyKeys(ctx context.Context, old []string, records []ingester.Scan) (int, error) {
+	gets := make([]*redis.StringCmd, len(old))
+	_, err := c.rcl.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range old {
+			gets[i] = pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+
+	var keys []string
+	var args [][]any
+	for i, get := range gets {
+		// the key might have expired since the scan, or hold something that
+		// isn't a timestamp. Either way there's nothing worth keeping.
+		timestamp, err := get.Int64()
+		if err != nil {
+			continue
+		}
+		keys = append(keys, c.key(keyFromRecord(records[i])))
+		args = append(args, []any{timestamp, c.ttl.Milliseconds()})
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if _, err := c.runPipelined(ctx, checkRecordScript, keys, args); err != nil {
+		cacheErrors.WithLabelValues("migrate").Inc()
+		return 0, err
+	}
+	return len(keys), nil
+}
@@ -2,79 +2,269 @@ package cache
 
 import (
 	"context"
-	"errors"
-	"fmt"
-	"strconv"
 	"time"
 
 	"github.com/censys/scan-takehome/pkg/ingester"
 	"github.com/redis/go-redis/v9"
 )
 
+// checkRecordScript does the compare and set in one go, so two workers racing
+// on the same key can't have the older timestamp win. Returns the status (0
+// for stale, 1 for a key we've never seen and 2 for a newer timestamp,
+// matching [ingester.RecordStatus]) along with the timestamp that was replaced.
+//
+// KEYS[1] is the record key, ARGV[1] the scan timestamp and ARGV[2] the ttl in
+// milliseconds, where 0 means no expiry.
+var checkRecordScript = redis.NewScript(`
+local cached = redis.call('GET', KEYS[1])
+local status = 1
+local previous = 0
+if cached then
+	previous = tonumber(cached)
+	if not previous then
+		return redis.error_reply('cached value for ' .. KEYS[1] .. ' is not a timestamp')
+	end
+	if previous >= tonumber(ARGV[1]) then
+		return {0, 0}
+	end
+	status = 2
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return {status, previous}
+`)
+
+// restoreRecordScript puts back the previous timestamp, but only if the key
+// still holds the one we set. If another worker has moved it on since, their
+// value wins. Returns 1 if the key was restored.
+//
+// KEYS[1] is the record key, ARGV[1] the timestamp we set, ARGV[2] the one to
+// put back (0 to delete the key) and ARGV[3] the ttl in milliseconds.
+var restoreRecordScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[2]) == 0 then
+	redis.call('DEL', KEYS[1])
+elseif tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
 // Cache when enabled will help determine if an incoming request is out of order.
 type Cache struct {
 	enabled bool
 	rcl     redis.UniversalClient
 	ttl     time.Duration
+	prefix  string
+	// l1 is an optional in memory tier checked before redis.
+	l1 *MemoryCache
+}
+
+// CacheOption provides additional configuration for the [Cache]
+type CacheOption func(*Cache)
+
+// WithL1 puts an in memory cache in front of redis. Scans the memory cache
+// already knows are stale never make it to redis, which saves a round trip
+// for the duplicates a single ingester sees. Anything else still goes to
+// redis, since that's the only place that knows what the other replicas saw.
+func WithL1(l1 *MemoryCache) CacheOption {
+	return func(c *Cache) {
+		c.l1 = l1
+	}
+}
+
+// WithKeyPrefix namespaces the keys with something other than
+// [DefaultKeyPrefix]. An empty prefix leaves the keys without one.
+func WithKeyPrefix(prefix string) CacheOption {
+	return func(c *Cache) {
+		c.prefix = prefix
+	}
 }
 
 // NewCache creates a new redis cache
-func NewCache(rcl redis.UniversalClient, ttl time.Duration) *Cache {
-	return &Cache{
+func NewCache(rcl redis.UniversalClient, ttl time.Duration, opts ...CacheOption) *Cache {
+	c := &Cache{
 		enabled: true,
 		rcl:     rcl,
 		ttl:     ttl,
+		prefix:  DefaultKeyPrefix,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
-func keyFromRecord(record ingester.Scan) string {
-	return fmt.Sprintf("%s-%d-%s", record.Ip, record.Port, record.Service)
-}
-
-// RecordIsNew checks the incoming scan to see if the record is out of order. If it is not,
-// it will update the cache with the newest timestamp.
-func (c *Cache) RecordIsNew(ctx context.Context, record ingester.Scan) (bool, error) {
-	key := keyFromRecord(record)
+// CheckRecord checks the incoming scan to see if the record is out of order. If it is not,
+// it will update the cache with the newest timestamp. Both happen in a single
+// script on the redis side, so concurrent workers can't step on each other.
+func (c *Cache) CheckRecord(ctx context.Context, record ingester.Scan) (ingester.RecordStatus, error) {
+	id := keyFromRecord(record)
+	if c.l1Stale(id, record.Timestamp) {
+		return ingester.RecordStale, nil
+	}
 
-	res, err := c.rcl.Get(ctx, key).Result()
+	res, err := checkRecordScript.Run(ctx, c.rcl, []string{c.key(id)}, record.Timestamp, c.ttl.Milliseconds()).Int64Slice()
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			if _, err := c.rcl.Set(ctx, key, record.Timestamp, c.ttl).Result(); err != nil {
-				return false, err
-			}
-			return true, nil
+		cacheErrors.WithLabelValues("check").Inc()
+		return ingester.RecordStale, err
+	}
+	return c.recordCheck(id, record.Timestamp, res).Status, nil
+}
+
+// CheckRecords checks a whole batch, running the same script as [CheckRecord]
+// for every record in a single pipeline so the batch costs one round trip.
+func (c *Cache) CheckRecords(ctx context.Context, records []ingester.Scan) ([]ingester.RecordCheck, error) {
+	checks := make([]ingester.RecordCheck, len(records))
+	// only what the memory tier can't answer for goes to redis.
+	var pending []int
+	var ids, keys []string
+	var args [][]any
+	for i, record := range records {
+		id := keyFromRecord(record)
+		if c.l1Stale(id, record.Timestamp) {
+			checks[i] = ingester.RecordCheck{Status: ingester.RecordStale}
+			continue
 		}
-		return false, err
+		pending = append(pending, i)
+		ids = append(ids, id)
+		keys = append(keys, c.key(id))
+		args = append(args, []any{record.Timestamp, c.ttl.Milliseconds()})
+	}
+	if len(pending) == 0 {
+		return checks, nil
 	}
 
-	unixTime, err := strconv.ParseInt(res, 10, 64)
+	cmds, err := c.runPipelined(ctx, checkRecordScript, keys, args)
 	if err != nil {
-		return false, err
+		cacheErrors.WithLabelValues("check").Inc()
+		return nil, err
 	}
 
-	// our record already exists and is newer. Move along.
-	// This also stops us from needing to keep track of the identifiers because
-	// we can use the ip/port/service and timestamp.
-	if unixTime >= record.Timestamp {
-		return false, nil
+	for j, i := range pending {
+		// any error would have come back from the pipeline already.
+		res, _ := cmds[j].Int64Slice()
+		checks[i] = c.recordCheck(ids[j], records[i].Timestamp, res)
 	}
+	return checks, nil
+}
 
-	if _, err := c.rcl.Set(ctx, key, record.Timestamp, c.ttl).Result(); err != nil {
-		return false, err
+// RestoreRecords puts back the timestamps the records replaced, in both tiers,
+// for any key that hasn't been updated by someone else since.
+func (c *Cache) RestoreRecords(ctx context.Context, restores []ingester.RecordRestore) (int64, error) {
+	if len(restores) == 0 {
+		return 0, nil
+	}
+	keys := make([]string, len(restores))
+	args := make([][]any, len(restores))
+	for i, r := range restores {
+		id := keyFromRecord(r.Record)
+		keys[i] = c.key(id)
+		args[i] = []any{r.Record.Timestamp, r.Previous, c.ttl.Milliseconds()}
+		if c.l1 != nil {
+			c.l1.restoreKey(id, r.Record.Timestamp, r.Previous)
+		}
 	}
 
-	return false, nil
+	cmds, err := c.runPipelined(ctx, restoreRecordScript, keys, args)
+	if err != nil {
+		cacheErrors.WithLabelValues("restore").Inc()
+		return 0, err
+	}
+	var restored int64
+	for _, cmd := range cmds {
+		n, _ := cmd.Int64()
+		restored += n
+	}
+	return restored, nil
 }
 
-// RemoveRecords will remove the records from the cache. Used in the event of
-// a flush failure and we need to see the messages again.
-func (c *Cache) RemoveRecords(ctx context.Context, records []ingester.Scan) (int64, error) {
-	var keys = make([]string, len(records))
+// WarmRecords seeds the cache with scans that are already saved, using the
+// same compare and set as [CheckRecords] so a warm up running alongside live
+// traffic can never move a key backwards.
+func (c *Cache) WarmRecords(ctx context.Context, records []ingester.Scan) error {
+	if len(records) == 0 {
+		return nil
+	}
+	keys := make([]string, len(records))
+	args := make([][]any, len(records))
 	for i, record := range records {
-		keys[i] = keyFromRecord(record)
+		keys[i] = c.key(keyFromRecord(record))
+		args[i] = []any{record.Timestamp, c.ttl.Milliseconds()}
+	}
+	if _, err := c.runPipelined(ctx, checkRecordScript, keys, args); err != nil {
+		cacheErrors.WithLabelValues("warm").Inc()
+		return err
 	}
+	if c.l1 != nil {
+		if err := c.l1.WarmRecords(ctx, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	res, err := c.rcl.Del(ctx, keys...).Result()
-	return res, err
+// runPipelined runs the script once per key in a single pipeline.
+func (c *Cache) runPipelined(ctx context.Context, script *redis.Script, keys []string, args [][]any) ([]*redis.Cmd, error) {
+	cmds, err := c.evalShaPipelined(ctx, script, keys, args)
+	if err != nil && redis.HasErrorPrefix(err, "NOSCRIPT") {
+		// the pipeline only sends the sha, so if redis restarted or had its
+		// script cache flushed we need to load it again first.
+		if err = script.Load(ctx, c.rcl).Err(); err == nil {
+			cmds, err = c.evalShaPipelined(ctx, script, keys, args)
+		}
+	}
+	return cmds, err
+}
 
+func (c *Cache) evalShaPipelined(ctx context.Context, script *redis.Script, keys []string, args [][]any) ([]*redis.Cmd, error) {
+	cmds := make([]*redis.Cmd, len(keys))
+	_, err := c.rcl.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = script.EvalSha(ctx, pipe, []string{key}, args[i]...)
+		}
+		return nil
+	})
+	return cmds, err
+}
+
+// l1Stale is true if the memory tier already knows about something at least
+// as new, so there's no need to ask redis. The memory tier is keyed without
+// the prefix.
+func (c *Cache) l1Stale(id string, timestamp int64) bool {
+	if c.l1 == nil {
+		return false
+	}
+	if cached, ok := c.l1.lookup(id); ok && cached >= timestamp {
+		lookups.WithLabelValues(tierMemory, "stale").Inc()
+		return true
+	}
+	return false
+}
+
+// recordCheck turns the script result into a check.
+func (c *Cache) recordCheck(id string, timestamp int64, res []int64) ingester.RecordCheck {
+	// This also stops us from needing to keep track of the identifiers because
+	// we can use the ip/port/transport/service and timestamp.
+	check := ingester.RecordCheck{Status: ingester.RecordStatus(res[0]), Previous: res[1]}
+	switch check.Status {
+	case ingester.RecordNew:
+		lookups.WithLabelValues(tierRedis, "miss").Inc()
+	case ingester.RecordNewer:
+		lookups.WithLabelValues(tierRedis, "hit").Inc()
+	default:
+		lookups.WithLabelValues(tierRedis, "stale").Inc()
+	}
+	// even when it's stale, redis has something at least this new.
+	if c.l1 != nil {
+		c.l1.observe(id, timestamp)
+	}
+	return check
 }
@@ -2,6 +2,8 @@ package cache
 
 import (
 	"context"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,17 +22,251 @@ func TestCache(t *testing.T) {
 		DB:       0,
 	})
 	subject := NewCache(rcl, time.Hour*1)
+	now := time.Now()
 
-	record := makeMessage(time.Now().Unix())
-	isNew, err := subject.RecordIsNew(context.Background(), record)
+	tests := []struct {
+		name      string
+		timestamp int64
+		expected  ingester.RecordStatus
+	}{
+		{name: "first time seeing the key", timestamp: now.Unix(), expected: ingester.RecordNew},
+		{name: "older is stale", timestamp: now.Add(time.Hour * -1).Unix(), expected: ingester.RecordStale},
+		{name: "same timestamp is stale", timestamp: now.Unix(), expected: ingester.RecordStale},
+		{name: "newer replaces the cached value", timestamp: now.Add(time.Minute).Unix(), expected: ingester.RecordNewer},
+		{name: "in between the two is now stale", timestamp: now.Add(time.Second).Unix(), expected: ingester.RecordStale},
+	}
+	for _, tt := range tests {
+		status, err := subject.CheckRecord(context.Background(), makeMessage(tt.timestamp))
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.expected, status, tt.name)
+	}
+
+	cached, err := s.Get(subject.key(keyFromRecord(makeMessage(0))))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(now.Add(time.Minute).Unix(), 10), cached)
+	assert.Equal(t, time.Hour, s.TTL(subject.key(keyFromRecord(makeMessage(0)))))
+}
+
+func TestCacheWithoutTTL(t *testing.T) {
+	s := miniredis.RunT(t)
+	subject := NewCache(redis.NewClient(&redis.Options{Addr: s.Addr()}), 0)
+
+	_, err := subject.CheckRecord(context.Background(), makeMessage(time.Now().Unix()))
+	assert.NoError(t, err)
+	assert.Zero(t, s.TTL(subject.key(keyFromRecord(makeMessage(0)))), "a ttl of 0 shouldn't expire keys")
+}
+
+func TestCacheRejectsGarbage(t *testing.T) {
+	s := miniredis.RunT(t)
+	subject := NewCache(redis.NewClient(&redis.Options{Addr: s.Addr()}), time.Hour)
+	s.Set(subject.key(keyFromRecord(makeMessage(0))), "not-a-timestamp")
+
+	_, err := subject.CheckRecord(context.Background(), makeMessage(time.Now().Unix()))
+	assert.Error(t, err)
+}
+
+// Hammer a single key from a bunch of workers at once. However the timestamps
+// interleave, the newest has to be what's left in the cache and only one
+// worker gets to see the key as new.
+func TestCacheConcurrentWriters(t *testing.T) {
+	s := miniredis.RunT(t)
+	rcl := redis.NewClient(&redis.Options{Addr: s.Addr(), PoolSize: 16})
+	subject := NewCache(rcl, time.Hour)
+
+	workers := 16
+	perWorker := 50
+	base := time.Now().Unix()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counts := map[ingester.RecordStatus]int{}
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				// spread each worker's timestamps across the whole range so
+				// they constantly leapfrog each other.
+				ts := base + int64(i*workers+w)
+				status, err := subject.CheckRecord(context.Background(), makeMessage(ts))
+				assert.NoError(t, err)
+				mu.Lock()
+				counts[status]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	cached, err := s.Get(subject.key(keyFromRecord(makeMessage(0))))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(base+int64(workers*perWorker-1), 10), cached)
+	assert.Equal(t, 1, counts[ingester.RecordNew])
+	assert.Equal(t, workers*perWorker, counts[ingester.RecordNew]+counts[ingester.RecordNewer]+counts[ingester.RecordStale])
+}
+
+func TestCacheWithL1(t *testing.T) {
+	s := miniredis.RunT(t)
+	subject := NewCache(redis.NewClient(&redis.Options{Addr: s.Addr()}), time.Hour, WithL1(NewMemoryCache()))
+	ctx := context.Background()
+
+	status, err := subject.CheckRecord(ctx, makeMessage(100))
+	assert.NoError(t, err)
+	assert.Equal(t, ingester.RecordNew, status)
+
+	// with redis emptied out, only the memory tier can know this is stale.
+	s.FlushAll()
+	status, err = subject.CheckRecord(ctx, makeMessage(50))
+	assert.NoError(t, err)
+	assert.Equal(t, ingester.RecordStale, status)
+	assert.False(t, s.Exists(subject.key(keyFromRecord(makeMessage(0)))), "stale scans shouldn't make it to redis")
+
+	// newer scans still go through redis so other replicas see them.
+	status, err = subject.CheckRecord(ctx, makeMessage(200))
+	assert.NoError(t, err)
+	assert.Equal(t, ingester.RecordNew, status)
+	assert.True(t, s.Exists(subject.key(keyFromRecord(makeMessage(0)))))
+
+	_, err = subject.RestoreRecords(ctx, []ingester.RecordRestore{{Record: makeMessage(200)}})
+	assert.NoError(t, err)
+	status, err = subject.CheckRecord(ctx, makeMessage(50))
+	assert.NoError(t, err)
+	assert.Equal(t, ingester.RecordNew, status, "restoring records should clear both tiers")
+}
+
+func TestCacheCheckRecords(t *testing.T) {
+	s := miniredis.RunT(t)
+	rcl := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	subject := NewCache(rcl, time.Hour)
+	ctx := context.Background()
+
+	seen := makeScan("1.1.1.1")
+	_, err := subject.CheckRecord(ctx, seen)
 	assert.NoError(t, err)
-	assert.True(t, isNew)
+	older := seen
+	older.Timestamp--
+	newer := makeScan("2.2.2.2")
+	_, err = subject.CheckRecord(ctx, newer)
+	assert.NoError(t, err)
+	newer.Timestamp++
+
+	// the script cache going away shouldn't matter, it gets loaded again.
+	assert.NoError(t, rcl.ScriptFlush(ctx).Err())
+
+	checks, err := subject.CheckRecords(ctx, []ingester.Scan{older, makeScan("3.3.3.3"), newer})
+	assert.NoError(t, err)
+	assert.Equal(t, []ingester.RecordCheck{
+		{Status: ingester.RecordStale},
+		{Status: ingester.RecordNew},
+		{Status: ingester.RecordNewer, Previous: newer.Timestamp - 1},
+	}, checks)
+
+	cached, err := s.Get(subject.key(keyFromRecord(newer)))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(newer.Timestamp, 10), cached)
+	assert.True(t, s.Exists(subject.key(keyFromRecord(makeScan("3.3.3.3")))))
+
+	s.Set(subject.key(keyFromRecord(seen)), "not-a-timestamp")
+	_, err = subject.CheckRecords(ctx, []ingester.Scan{seen})
+	assert.Error(t, err)
+}
+
+func TestCacheRestoreRecords(t *testing.T) {
+	s := miniredis.RunT(t)
+	rcl := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	subject := NewCache(rcl, time.Hour, WithL1(NewMemoryCache()))
+	ctx := context.Background()
 
-	record2 := makeMessage(time.Now().Add(time.Hour * -1).Unix())
-	isNew, err = subject.RecordIsNew(context.Background(), record2)
+	saved := makeScan("1.1.1.1")
+	failed := saved
+	failed.Timestamp += 10
+	unseen := makeScan("2.2.2.2")
+	moved := makeScan("3.3.3.3")
+	_, err := subject.CheckRecords(ctx, []ingester.Scan{saved})
 	assert.NoError(t, err)
-	assert.False(t, isNew)
+	checks, err := subject.CheckRecords(ctx, []ingester.Scan{failed, unseen, moved})
+	assert.NoError(t, err)
+	assert.Equal(t, saved.Timestamp, checks[0].Previous)
+
+	// another replica saves something newer for 3.3.3.3 in the meantime.
+	s.Set(subject.key(keyFromRecord(moved)), strconv.FormatInt(moved.Timestamp+5, 10))
+	assert.NoError(t, rcl.ScriptFlush(ctx).Err())
+
+	restores := []ingester.RecordRestore{}
+	for i, record := range []ingester.Scan{failed, unseen, moved} {
+		restores = append(restores, ingester.RecordRestore{Record: record, Previous: checks[i].Previous})
+	}
+	restored, err := subject.RestoreRecords(ctx, restores)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), restored)
+
+	cached, err := s.Get(subject.key(keyFromRecord(saved)))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(saved.Timestamp, 10), cached)
+	assert.Equal(t, time.Hour, s.TTL(subject.key(keyFromRecord(saved))))
+	assert.False(t, s.Exists(subject.key(keyFromRecord(unseen))))
+	cached, err = s.Get(subject.key(keyFromRecord(moved)))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(moved.Timestamp+5, 10), cached)
+
+	// the memory tier is rolled back too, so a redelivery of the failed scan
+	// isn't mistaken for stale.
+	status, err := subject.CheckRecord(ctx, failed)
+	assert.NoError(t, err)
+	assert.Equal(t, ingester.RecordNewer, status)
+}
+
+func TestCacheWarmRecords(t *testing.T) {
+	s := miniredis.RunT(t)
+	subject := NewCache(redis.NewClient(&redis.Options{Addr: s.Addr()}), time.Hour, WithL1(NewMemoryCache()))
+	ctx := context.Background()
+	newer := makeMessage(200)
+	_, err := subject.CheckRecord(ctx, newer)
+	assert.NoError(t, err)
+
+	assert.NoError(t, subject.WarmRecords(ctx, []ingester.Scan{makeMessage(100), makeScan("2.2.2.2")}))
+	cached, err := s.Get(subject.key(keyFromRecord(newer)))
+	assert.NoError(t, err)
+	assert.Equal(t, "200", cached, "warming shouldn't move a key backwards")
+	assert.True(t, s.Exists(subject.key(keyFromRecord(makeScan("2.2.2.2")))))
+	_, ok := subject.l1.lookup(keyFromRecord(makeScan("2.2.2.2")))
+	assert.True(t, ok, "the memory tier should be warmed too")
+}
+
+func TestCacheCheckRecordsWithL1(t *testing.T) {
+	s := miniredis.RunT(t)
+	subject := NewCache(redis.NewClient(&redis.Options{Addr: s.Addr()}), time.Hour, WithL1(NewMemoryCache()))
+	ctx := context.Background()
+
+	seen := makeScan("1.1.1.1")
+	_, err := subject.CheckRecords(ctx, []ingester.Scan{seen})
+	assert.NoError(t, err)
+
+	// everything in the batch is stale according to the memory tier, so redis
+	// doesn't get asked.
+	s.Close()
+	checks, err := subject.CheckRecords(ctx, []ingester.Scan{seen})
+	assert.NoError(t, err)
+	assert.Equal(t, []ingester.RecordCheck{{Status: ingester.RecordStale}}, checks)
+}
+
+// A stale scan the memory tier catches has to stay out of the upsert, not only
+// skip the trip to redis.
+func TestL1HitKeepsStaleScansOutOfTheUpsert(t *testing.T) {
+	s := miniredis.RunT(t)
+	l1 := NewMemoryCache()
+	subject := NewCache(redis.NewClient(&redis.Options{Addr: s.Addr()}), time.Hour, WithL1(l1))
+
+	// only the memory tier has seen it, so it's down to the L1 to catch the
+	// older scan.
+	saved := makeScan("1.1.1.1")
+	assert.NoError(t, l1.WarmRecords(context.Background(), []ingester.Scan{saved}))
+	older := saved
+	older.Timestamp -= 60
 
+	upserted := upsertThroughCache(t, subject, older, makeScan("2.2.2.2"))
+	assert.Equal(t, []string{"2.2.2.2"}, ips(upserted))
+	assert.False(t, s.Exists(subject.key(keyFromRecord(older))), "redis shouldn't have been asked about the stale scan")
 }
 
 func makeMessage(timestamp int64) ingester.Scan {
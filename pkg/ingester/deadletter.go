@@ -0,0 +1,111 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// DeadLetterReason is a short, machine friendly description of why a message
+// could not be processed.
+type DeadLetterReason string
+
+const (
+	// ReasonMalformedPayload is used when the message body isn't valid json
+	// for a scan.
+	ReasonMalformedPayload DeadLetterReason = "malformed_payload"
+	// ReasonUnknownDataVersion is used when the scan has a data_version the
+	// ingester doesn't know how to decode.
+	ReasonUnknownDataVersion DeadLetterReason = "unknown_data_version"
+	// ReasonDisabledDataVersion is used when the scan has a data_version that
+	// has been turned off in config.
+	ReasonDisabledDataVersion DeadLetterReason = "disabled_data_version"
+	// ReasonInvalidScan is used when the scan decoded fine but was rejected
+	// by the [Validator]. The error says which check it failed.
+	ReasonInvalidScan DeadLetterReason = "invalid_scan"
+	// ReasonUpsertFailed is used when the scan decoded fine but the data store
+	// refuses it, even when it's saved on its own.
+	ReasonUpsertFailed DeadLetterReason = "upsert_failed"
+	// ReasonMaxDeliveryAttempts is used by sources without a dead letter
+	// policy of their own (kafka) when a message has been nacked too many
+	// times.
+	ReasonMaxDeliveryAttempts DeadLetterReason = "max_delivery_attempts"
+)
+
+// Attribute keys set on dead lettered messages so the original message can be
+// tracked down later.
+const (
+	AttributeReason          = "deadletter_reason"
+	AttributeError           = "deadletter_error"
+	AttributeMessageID       = "original_message_id"
+	AttributeDeliveryAttempt = "delivery_attempt"
+	AttributeFailedAt        = "failed_at"
+)
+
+// MaxAttributeLength is the longest attribute value pubsub will accept, in
+// bytes. Anything longer fails the publish.
+const MaxAttributeLength = 1024
+
+// DeadLetter is a payload that can never be processed, along with enough
+// information about the original message to figure out what went wrong.
+type DeadLetter struct {
+	Data            []byte           `json:"data"`
+	Reason          DeadLetterReason `json:"reason"`
+	Error           string           `json:"error"`
+	MessageID       string           `json:"message_id"`
+	DeliveryAttempt int              `json:"delivery_attempt"`
+	FailedAt        time.Time        `json:"failed_at"`
+}
+
+// Attributes flattens the metadata of the dead letter into a set of string
+// attributes, suitable for pubsub messages. Errors can be any length, so the
+// error is cut down to fit, the full text is only in Error.
+func (d DeadLetter) Attributes() map[string]string {
+	return map[string]string{
+		AttributeReason:          string(d.Reason),
+		AttributeError:           truncateAttribute(d.Error),
+		AttributeMessageID:       d.MessageID,
+		AttributeDeliveryAttempt: strconv.Itoa(d.DeliveryAttempt),
+		AttributeFailedAt:        d.FailedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// Body is the original payload, so a dead letter can be replayed as it is.
+func (d DeadLetter) Body() ([]byte, error) {
+	return d.Data, nil
+}
+
+// truncateAttribute cuts s down to [MaxAttributeLength] without splitting a
+// utf-8 character, marking it as cut short.
+func truncateAttribute(s string) string {
+	if len(s) <= MaxAttributeLength {
+		return s
+	}
+	const marker = "...(truncated)"
+	cut := MaxAttributeLength - len(marker)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + marker
+}
+
+// DeadLetterer stores payloads that failed processing somewhere we can look at
+// them later, so that the original message can be acked instead of being
+// redelivered forever.
+type DeadLetterer interface {
+	DeadLetter(ctx context.Context, letter DeadLetter) error
+}
+
+// reasonForError maps a decoding error to the reason we attach to the
+// dead letter.
+func reasonForError(err error) DeadLetterReason {
+	switch {
+	case errors.Is(err, ErrUnknownDataVersion):
+		return ReasonUnknownDataVersion
+	case errors.Is(err, ErrDisabledDataVersion):
+		return ReasonDisabledDataVersion
+	}
+	return ReasonMalformedPayload
+}
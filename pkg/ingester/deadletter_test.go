@@ -0,0 +1,22 @@
+package ingester
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterAttributesTruncateError(t *testing.T) {
+	short := DeadLetter{Error: "invalid character"}
+	assert.Equal(t, "invalid character", short.Attributes()[AttributeError])
+
+	// a multi byte character straddling the limit mustn't be split.
+	long := DeadLetter{Error: strings.Repeat("x", MaxAttributeLength-15) + strings.Repeat("é", 1000)}
+	attr := long.Attributes()[AttributeError]
+	assert.LessOrEqual(t, len(attr), MaxAttributeLength)
+	assert.True(t, utf8.ValidString(attr))
+	assert.True(t, strings.HasSuffix(attr, "...(truncated)"))
+	assert.Len(t, long.Error, MaxAttributeLength-15+2000, "the letter keeps the whole error")
+}
@@ -0,0 +1,187 @@
+package ingester
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/censys/scan-takehome/pkg/scanning"
+)
+
+// ErrDisabledDataVersion is returned when a scan arrives with a data version
+// that has been turned off in config.
+var ErrDisabledDataVersion = errors.New("disabled Data Version type")
+
+// DecodedData is the normalized form every data version is decoded into, so
+// nothing past decoding needs to care which version a scan came in as.
+type DecodedData struct {
+	// Response is the response exactly as the scanner saw it. It's sanitized
+	// for display after decoding, so decoders don't need to worry about
+	// binary data or odd charsets.
+	Response []byte
+	// Protocol is the structured part of the response, for versions that
+	// have one. Nil otherwise.
+	Protocol *scanning.ProtocolData
+}
+
+// DataDecoder decodes the data field of a scan for a single data version.
+type DataDecoder func(data json.RawMessage) (DecodedData, error)
+
+// DataVersionStatus is whether scans of a data version are accepted.
+type DataVersionStatus int
+
+const (
+	// DataVersionEnabled versions are decoded as normal.
+	DataVersionEnabled DataVersionStatus = iota
+	// DataVersionDeprecated versions are still decoded, but counted and
+	// warned about so we know who still sends them before turning them off.
+	DataVersionDeprecated
+	// DataVersionDisabled versions are rejected with ErrDisabledDataVersion.
+	DataVersionDisabled
+)
+
+func (s DataVersionStatus) String() string {
+	switch s {
+	case DataVersionEnabled:
+		return "enabled"
+	case DataVersionDeprecated:
+		return "deprecated"
+	case DataVersionDisabled:
+		return "disabled"
+	default:
+		return "unknown"
+	}
+}
+
+// DataVersionInfo describes a registered data version.
+type DataVersionInfo struct {
+	Version int
+	Status  DataVersionStatus
+}
+
+// decoderRegistry holds the decoder for every data version we know about.
+// [Scan.UnmarshalJSON] has no way to be handed one, so there's a single
+// package level registry, the same way database/sql handles drivers.
+type decoderRegistry struct {
+	mu       sync.RWMutex
+	versions map[int]*registeredDecoder
+}
+
+type registeredDecoder struct {
+	decode DataDecoder
+	status DataVersionStatus
+}
+
+var decoders = &decoderRegistry{versions: map[int]*registeredDecoder{}}
+
+func init() {
+	RegisterDecoder(scanning.V1, func(data json.RawMessage) (DecodedData, error) {
+		var v1Data scanning.V1Data
+		if err := json.Unmarshal(data, &v1Data); err != nil {
+			return DecodedData{}, err
+		}
+		return DecodedData{Response: v1Data.ResponseBytesUtf8}, nil
+	})
+	RegisterDecoder(scanning.V2, func(data json.RawMessage) (DecodedData, error) {
+		var v2Data scanning.V2Data
+		if err := json.Unmarshal(data, &v2Data); err != nil {
+			return DecodedData{}, err
+		}
+		return DecodedData{Response: []byte(v2Data.ResponseStr)}, nil
+	})
+	RegisterDecoder(scanning.V3, func(data json.RawMessage) (DecodedData, error) {
+		var v3Data scanning.V3Data
+		if err := json.Unmarshal(data, &v3Data); err != nil {
+			return DecodedData{}, err
+		}
+		decoded := DecodedData{Response: []byte(v3Data.ResponseStr)}
+		if !v3Data.ProtocolData.Empty() {
+			decoded.Protocol = &v3Data.ProtocolData
+		}
+		return decoded, nil
+	})
+}
+
+// RegisterDecoder adds the decoder for a new data version. It's meant to be
+// called from init(), and panics if the version already has a decoder.
+func RegisterDecoder(version int, decode DataDecoder) {
+	decoders.mu.Lock()
+	defer decoders.mu.Unlock()
+	if decode == nil {
+		panic(fmt.Sprintf("ingester: decoder for data version %d is nil", version))
+	}
+	if _, ok := decoders.versions[version]; ok {
+		panic(fmt.Sprintf("ingester: decoder for data version %d registered twice", version))
+	}
+	decoders.versions[version] = &registeredDecoder{decode: decode}
+}
+
+// SetDataVersionStatus enables, deprecates or disables a registered data
+// version. Errors if there's no decoder for the version.
+func SetDataVersionStatus(version int, status DataVersionStatus) error {
+	decoders.mu.Lock()
+	defer decoders.mu.Unlock()
+	d, ok := decoders.versions[version]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownDataVersion, version)
+	}
+	d.status = status
+	return nil
+}
+
+// SupportedVersions lists the data versions that will be decoded, deprecated
+// or not, in order.
+func SupportedVersions() []DataVersionInfo {
+	var supported []DataVersionInfo
+	for _, v := range decoders.all() {
+		if v.Status != DataVersionDisabled {
+			supported = append(supported, v)
+		}
+	}
+	return supported
+}
+
+// all lists every registered data version, disabled included, in order.
+func (r *decoderRegistry) all() []DataVersionInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions := make([]DataVersionInfo, 0, len(r.versions))
+	for version, d := range r.versions {
+		versions = append(versions, DataVersionInfo{Version: version, Status: d.status})
+	}
+	slices.SortFunc(versions, func(a, b DataVersionInfo) int { return a.Version - b.Version })
+	return versions
+}
+
+// status returns the status of the version and whether it's registered at
+// all.
+func (r *decoderRegistry) status(version int) (DataVersionStatus, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.versions[version]
+	if !ok {
+		return 0, false
+	}
+	return d.status, true
+}
+
+// decode runs the decoder for the version, unless it's unknown or disabled.
+func (r *decoderRegistry) decode(version int, data json.RawMessage) (DecodedData, error) {
+	r.mu.RLock()
+	d, ok := r.versions[version]
+	var status DataVersionStatus
+	if ok {
+		status = d.status
+	}
+	r.mu.RUnlock()
+
+	switch {
+	case !ok:
+		return DecodedData{}, fmt.Errorf("%w: %d", ErrUnknownDataVersion, version)
+	case status == DataVersionDisabled:
+		return DecodedData{}, fmt.Errorf("%w: %d", ErrDisabledDataVersion, version)
+	}
+	return d.decode(data)
+}
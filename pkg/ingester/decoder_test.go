@@ -0,0 +1,92 @@
+package ingester
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/censys/scan-takehome/pkg/scanning"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterDecoder(t *testing.T) {
+	const version = 1000
+	RegisterDecoder(version, func(data json.RawMessage) (DecodedData, error) {
+		var d struct {
+			Banner string `json:"banner"`
+		}
+		err := json.Unmarshal(data, &d)
+		return DecodedData{Response: []byte(d.Banner)}, err
+	})
+	t.Cleanup(func() {
+		decoders.mu.Lock()
+		delete(decoders.versions, version)
+		decoders.mu.Unlock()
+	})
+
+	var s Scan
+	err := json.Unmarshal([]byte(`{"ip": "1.1.1.1", "port": 22, "service": "SSH", "data_version": 1000, "data": {"banner": "SSH-2.0"}}`), &s)
+	assert.NoError(t, err)
+	assert.Equal(t, "SSH-2.0", s.Response)
+	assert.Contains(t, SupportedVersions(), DataVersionInfo{Version: version})
+
+	assert.Panics(t, func() {
+		RegisterDecoder(version, func(json.RawMessage) (DecodedData, error) { return DecodedData{}, nil })
+	}, "a version can only have one decoder")
+}
+
+func TestDataVersionStatus(t *testing.T) {
+	t.Cleanup(func() {
+		_ = SetDataVersionStatus(scanning.V1, DataVersionEnabled)
+		_ = SetDataVersionStatus(scanning.V2, DataVersionEnabled)
+	})
+	assert.ErrorIs(t, SetDataVersionStatus(99, DataVersionDisabled), ErrUnknownDataVersion)
+
+	assert.NoError(t, SetDataVersionStatus(scanning.V1, DataVersionDisabled))
+	assert.NoError(t, SetDataVersionStatus(scanning.V2, DataVersionDeprecated))
+	assert.Equal(t, []DataVersionInfo{
+		{Version: scanning.V2, Status: DataVersionDeprecated},
+		{Version: scanning.V3, Status: DataVersionEnabled},
+	}, SupportedVersions())
+
+	var s Scan
+	assert.ErrorIs(t, json.Unmarshal(ScanToBytes(t, newScan(scanning.V1)), &s), ErrDisabledDataVersion)
+	assert.NoError(t, json.Unmarshal(ScanToBytes(t, newScan(scanning.V2)), &s), "deprecated versions still decode")
+	assert.Equal(t, "service response: 111", s.Response)
+}
+
+func TestDecodeV3(t *testing.T) {
+	http := newScan(scanning.V3)
+	http.Data = &scanning.V3Data{
+		ResponseStr: "HTTP/1.1 200 OK",
+		ProtocolData: scanning.ProtocolData{
+			HTTP: &scanning.HTTPData{StatusCode: 200, Title: "hello", Headers: map[string][]string{"Server": {"nginx"}}},
+		},
+	}
+	unparsed := newScan(scanning.V3)
+	unparsed.Data = &scanning.V3Data{ResponseStr: "garbage"}
+
+	var s Scan
+	assert.NoError(t, json.Unmarshal(ScanToBytes(t, http), &s))
+	assert.Equal(t, "HTTP/1.1 200 OK", s.Response)
+	if assert.NotNil(t, s.Protocol) && assert.NotNil(t, s.Protocol.HTTP) {
+		assert.Equal(t, 200, s.Protocol.HTTP.StatusCode)
+		assert.Equal(t, []string{"nginx"}, s.Protocol.HTTP.Headers["Server"])
+		assert.Nil(t, s.Protocol.SSH)
+	}
+
+	s = Scan{}
+	assert.NoError(t, json.Unmarshal(ScanToBytes(t, unparsed), &s))
+	assert.Equal(t, "garbage", s.Response)
+	assert.Nil(t, s.Protocol, "no protocol section means no protocol")
+}
+
+func TestDecodeBinaryResponse(t *testing.T) {
+	banner := newScan(scanning.V1)
+	banner.Data = &scanning.V1Data{ResponseBytesUtf8: []byte("\x00\x01caf\xe9")}
+
+	var s Scan
+	assert.NoError(t, json.Unmarshal(ScanToBytes(t, banner), &s))
+	assert.Equal(t, []byte("\x00\x01caf\xe9"), s.ResponseRaw, "the raw response is kept as is")
+	assert.Equal(t, "��café", s.Response)
+	assert.False(t, s.ResponseValidUTF8)
+}
@@ -0,0 +1,70 @@
+package ingester
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// ChangeEventType says what happened to a service.
+type ChangeEventType string
+
+const (
+	// EventServiceDiscovered is used the first time an ip/port/transport/service
+	// is saved.
+	EventServiceDiscovered ChangeEventType = "service.discovered"
+	// EventServiceChanged is used when a newer scan has a different response to
+	// the one saved.
+	EventServiceChanged ChangeEventType = "service.changed"
+)
+
+// Attribute keys set on published change events, so subscribers can filter on
+// them without decoding the body.
+const (
+	AttributeEventType = "event_type"
+	AttributeIP        = "ip"
+	AttributePort      = "port"
+	AttributeTransport = "transport"
+	AttributeService   = "service"
+)
+
+// ChangeEvent is published when a service shows up for the first time or its
+// response changes. Hashes are the hex sha256 of the raw response, the
+// previous one is empty for discoveries.
+type ChangeEvent struct {
+	Type                 ChangeEventType `json:"type"`
+	Ip                   string          `json:"ip"`
+	Port                 uint32          `json:"port"`
+	Transport            string          `json:"transport"`
+	Service              string          `json:"service"`
+	PreviousResponseHash string          `json:"previous_response_hash,omitempty"`
+	ResponseHash         string          `json:"response_hash"`
+	// Response is the sanitized text of the new response.
+	Response   string    `json:"response"`
+	ObservedAt time.Time `json:"observed_at"`
+}
+
+// Attributes flattens the identity of the event into a set of string
+// attributes, suitable for pubsub messages.
+func (e ChangeEvent) Attributes() map[string]string {
+	return map[string]string{
+		AttributeEventType: string(e.Type),
+		AttributeIP:        e.Ip,
+		AttributePort:      strconv.FormatUint(uint64(e.Port), 10),
+		AttributeTransport: e.Transport,
+		AttributeService:   e.Service,
+	}
+}
+
+// Body is the event as json.
+func (e ChangeEvent) Body() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// EventPublisher sends change events on to whoever is interested. Publish
+// should only return once every event has been accepted, since the events are
+// thrown away afterwards. If it fails they're all sent again later.
+type EventPublisher interface {
+	Publish(ctx context.Context, events []ChangeEvent) error
+}
@@ -4,39 +4,85 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"strconv"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 type messageResponse struct {
 	err error
+	// poison is set when the data store rejected the scan on its own, so
+	// retrying it isn't going to help.
+	poison bool
 }
 
 type messageRequest struct {
 	scan Scan
 	Res  chan messageResponse
+	// spanCtx is the span of the message this scan came from, so the upserter
+	// can attach its own spans to the same trace.
+	spanCtx trace.SpanContext
+	// waitSpan covers the time the scan spends waiting in a batch.
+	waitSpan trace.Span
+	// restore undoes the cache update made when the scan was checked, if the
+	// cache was updated at all.
+	restore *RecordRestore
 }
 
-// PubSubMessage is interfaced so we can pull out the logic into [ReceiveMessage]
-// and test appropriately. This is a bit clunky in my opinion, but pstest wasn't
-// playing nicely with my attempts to create a mock server (similar pattern to
-// httptest)
-type PubSubMessage interface {
+// respond answers the ingester waiting on the message.
+func (m *messageRequest) respond(res messageResponse) {
+	if m.waitSpan != nil {
+		if res.err != nil {
+			m.waitSpan.SetStatus(codes.Error, res.err.Error())
+		}
+		m.waitSpan.End()
+	}
+	m.Res <- res
+}
+
+// Handle acks or nacks a message with whichever [Source] it came from. It's
+// interfaced so the logic in receiveMessage can be tested without a real
+// source, pstest wasn't playing nicely with my attempts to create a mock
+// server (similar pattern to httptest).
+type Handle interface {
 	Ack()
 	Nack()
 }
 
-// Ingester is the service that will listen on a pubsub subscription and
+// MessageInfo carries the identifying details of a message. These are not
+// needed to process a scan, but are useful when something goes wrong with one.
+type MessageInfo struct {
+	ID              string
+	DeliveryAttempt int
+	// Attributes are any key/values sent along with the message, like pubsub
+	// attributes or kafka headers. Trace context is picked up from here.
+	Attributes map[string]string
+}
+
+// Ingester is the service that will listen on a message [Source] and
 // orchestrate any work to additional processors. It will wait a default of
 // 30 seconds for the upserter of a message to respond back with a successful
 // insert. Otherwise it will send a Nack().
 type Ingester struct {
 	SendChan chan *messageRequest
 	l        *zap.Logger
-	sub      *pubsub.Subscription
+	source   Source
 	waitTime time.Duration
+	dlq      DeadLetterer
+	// validator checks scans before they're sent to the upserter, and
+	// quarantine is where the ones it rejects end up.
+	validator  *Validator
+	quarantine DeadLetterer
+	// deprecatedSeen is the deprecated data versions we've already warned
+	// about, so the logs only hear about each one once.
+	deprecatedSeen sync.Map
 }
 
 // IngesterOption provides additional configuration options for the ingester
@@ -58,11 +104,37 @@ func WithMessageAckTimeout(t time.Duration) IngesterOption {
 	}
 }
 
+// WithDeadLetter will send any message that cannot be decoded to the provided
+// [DeadLetterer] and ack the original. Without it, undecodable messages are
+// logged and left for pubsub to redeliver.
+func WithDeadLetter(d DeadLetterer) IngesterOption {
+	return func(i *Ingester) {
+		i.dlq = d
+	}
+}
+
+// WithValidator checks every decoded scan with the provided [Validator] before
+// it's sent to the upserter. Rejected scans are quarantined.
+func WithValidator(v *Validator) IngesterOption {
+	return func(i *Ingester) {
+		i.validator = v
+	}
+}
+
+// WithQuarantine sends scans rejected by the validator to their own
+// [DeadLetterer] instead of the dead letter sink, so they can be looked at
+// separately from payloads that were broken outright.
+func WithQuarantine(d DeadLetterer) IngesterOption {
+	return func(i *Ingester) {
+		i.quarantine = d
+	}
+}
+
 // NewIngester creates a new Ingester instance with the provided configurations
-func NewIngester(l *zap.Logger, sub *pubsub.Subscription, opts ...IngesterOption) *Ingester {
+func NewIngester(l *zap.Logger, source Source, opts ...IngesterOption) *Ingester {
 	ingester := &Ingester{
 		l:        l,
-		sub:      sub,
+		source:   source,
 		SendChan: make(chan *messageRequest),
 		waitTime: time.Second * 30,
 	}
@@ -75,12 +147,11 @@ func NewIngester(l *zap.Logger, sub *pubsub.Subscription, opts ...IngesterOption
 
 }
 
-// Start the ingester and listen for messages from the pubsub. It will then
+// Start the ingester and listen for messages from the source. It will then
 // send the records to the Upserter for consideration
 func (i *Ingester) Start(ctx context.Context) error {
-	err := i.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
-		i.receiveMessage(ctx, m.Data, m)
-
+	err := i.source.Receive(ctx, func(ctx context.Context, m Message) {
+		i.receiveMessage(ctx, m.Data, m.Info, m.Handle)
 	})
 
 	if err != nil && !errors.Is(err, context.Canceled) {
@@ -89,44 +160,167 @@ func (i *Ingester) Start(ctx context.Context) error {
 	return nil
 }
 
-// keeping the context around in the event we ever wanted to do tracing or other
-// things that would require a context.
-func (i *Ingester) receiveMessage(_ context.Context, data []byte, m PubSubMessage) {
-	i.l.Debug("received pubsub message")
+// receiveMessage decodes the message and hands it to the upserters, then acks
+// or nacks it based on the answer. If the message carries trace context in its
+// attributes, the spans here become part of that trace.
+func (i *Ingester) receiveMessage(ctx context.Context, data []byte, info MessageInfo, m Handle) {
+	i.l.Debug("received message", zap.String("messageID", info.ID))
+
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(info.Attributes))
+	ctx, span := tracer().Start(ctx, "ingester.receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.message.id", info.ID),
+			attribute.Int("messaging.delivery_attempt", info.DeliveryAttempt),
+		),
+	)
+	defer span.End()
 
 	var msg Scan
+	_, parseSpan := tracer().Start(ctx, "ingester.parse")
 	err := json.Unmarshal(data, &msg)
 	if err != nil {
-		i.l.Error("error unmarshaling!", zap.Error(err))
+		parseSpan.RecordError(err)
+		parseSpan.SetStatus(codes.Error, "failed to decode scan")
+	}
+	parseSpan.End()
+	if err != nil {
+		version := dataVersionLabel(data)
+		reason := reasonForError(err)
+		messagesReceived.WithLabelValues(version).Inc()
+		messagesFailed.WithLabelValues(version, string(reason)).Inc()
+		i.l.Error("error unmarshaling!", zap.Error(err), zap.String("messageID", info.ID))
+		if result := i.deadLetter(ctx, i.dlq, data, info, reason, err, m); result != "" {
+			messageResults.WithLabelValues(result).Inc()
+		}
 		return
 	}
+	version := strconv.Itoa(msg.DataVersion)
+	messagesReceived.WithLabelValues(version).Inc()
+	messagesParsed.WithLabelValues(version).Inc()
+	if status, _ := decoders.status(msg.DataVersion); status == DataVersionDeprecated {
+		messagesDeprecated.WithLabelValues(version).Inc()
+		if _, seen := i.deprecatedSeen.LoadOrStore(msg.DataVersion, true); !seen {
+			i.l.Warn("received a scan with a deprecated data version", zap.Int("dataVersion", msg.DataVersion))
+		}
+	}
 
-	doneChan := make(chan messageResponse)
+	if i.validator != nil {
+		if err := i.validator.Validate(&msg); err != nil {
+			i.reject(ctx, data, info, version, err, m)
+			span.SetStatus(codes.Error, "invalid scan")
+			return
+		}
+	}
 
-	// this could be wrapped in a select statement with a timer if we wanted
-	// more control on the Nack().
-	i.SendChan <- &messageRequest{scan: msg, Res: doneChan}
+	// buffered so the upserter can always answer, even if we've already given
+	// up waiting on it.
+	doneChan := make(chan messageResponse, 1)
+
+	span.SetAttributes(
+		attribute.String("scan.key", msg.Key()),
+		attribute.Int("scan.data_version", msg.DataVersion),
+	)
+
+	// the upserters stop with the context, so once it's done there may be
+	// nobody left to take the scan. Hand it back so the source can return.
+	select {
+	case i.SendChan <- &messageRequest{scan: msg, Res: doneChan, spanCtx: span.SpanContext()}:
+	case <-ctx.Done():
+		i.l.Debug("shutting down, leaving message for redelivery", zap.String("messageID", info.ID))
+		messageResults.WithLabelValues(resultNack).Inc()
+		span.SetStatus(codes.Error, "message not saved")
+		m.Nack()
+		return
+	}
 
 	// I'm not sure how much of a loop we're in above us, but simply using time.After
 	// _may_ lead to memory leaks, especially in versions of go  < 1.24
 	ticker := time.NewTicker(i.waitTime)
 	defer ticker.Stop()
+	start := time.Now()
 
+	var result string
 	select {
 	case res := <-doneChan:
-		if res.err != nil {
-			i.l.Error("failed to save message", zap.Error(err))
-			// this would be a good place to have prometheus metrics so we could
-			// see our rate of success vs failure on inserts, and the duration
-			// it took to insert the message. Sadly I don't have the time to set
-			// that up right now.
-			m.Nack()
-		} else {
+		switch {
+		case res.err == nil:
+			result = resultAck
 			m.Ack()
+		case res.poison && i.dlq != nil:
+			i.l.Error("scan can't be saved, dead lettering", zap.Error(res.err), zap.String("messageID", info.ID))
+			result = i.deadLetter(ctx, i.dlq, data, info, ReasonUpsertFailed, res.err, m)
+		default:
+			i.l.Error("failed to save message", zap.Error(res.err))
+			result = resultNack
+			m.Nack()
 		}
 
 	case <-ticker.C:
 		i.l.Debug("failed to save message")
+		result = resultTimeout
 		m.Nack()
 	}
+	messageResults.WithLabelValues(result).Inc()
+	messageDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.String("ingester.result", result))
+	if result != resultAck {
+		span.SetStatus(codes.Error, "message not saved")
+	}
+}
+
+// deadLetter hands the payload off to the dead letter sink and acks the
+// original message. If there is no sink, or the sink fails, the message is
+// left alone or nacked respectively so we don't lose anything. The result is
+// returned for metrics, and is empty if the message was left alone.
+func (i *Ingester) deadLetter(ctx context.Context, sink DeadLetterer, data []byte, info MessageInfo, reason DeadLetterReason, cause error, m Handle) string {
+	if sink == nil {
+		return ""
+	}
+
+	letter := DeadLetter{
+		Data:            data,
+		Reason:          reason,
+		Error:           cause.Error(),
+		MessageID:       info.ID,
+		DeliveryAttempt: info.DeliveryAttempt,
+		FailedAt:        time.Now(),
+	}
+	if err := sink.DeadLetter(ctx, letter); err != nil {
+		i.l.Error("failed to dead letter message", zap.Error(err), zap.String("messageID", info.ID))
+		m.Nack()
+		return resultNack
+	}
+	i.l.Warn("message dead lettered",
+		zap.String("messageID", info.ID),
+		zap.String("reason", string(reason)),
+	)
+	m.Ack()
+	return resultDeadLetter
+}
+
+// reject quarantines a scan the validator turned down. Without a quarantine
+// sink it goes to the dead letter sink, and without either it's logged and
+// left for the source to redeliver, the same as a payload that won't decode.
+func (i *Ingester) reject(ctx context.Context, data []byte, info MessageInfo, version string, err error, m Handle) {
+	reason := ValidationReason("unknown")
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		reason = verr.Reason
+	}
+	scansRejected.WithLabelValues(version, string(reason)).Inc()
+	messagesFailed.WithLabelValues(version, string(ReasonInvalidScan)).Inc()
+	i.l.Warn("scan rejected",
+		zap.Error(err),
+		zap.String("messageID", info.ID),
+		zap.String("reason", string(reason)),
+	)
+
+	sink := i.quarantine
+	if sink == nil {
+		sink = i.dlq
+	}
+	if result := i.deadLetter(ctx, sink, data, info, ReasonInvalidScan, err, m); result != "" {
+		messageResults.WithLabelValues(result).Inc()
+	}
 }
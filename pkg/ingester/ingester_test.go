@@ -8,16 +8,14 @@ import (
 	"time"
 
 	"github.com/censys/scan-takehome/pkg/scanning"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap/zaptest"
 )
 
-// Because we're using the Receive function in Start() and it doesn't
-// necessarily make sense to pull out that functionality into an interface
-// because the core logic is in [receiveMessage] we'll instead use that instead.
-// [Start] can be tested with integration tests. You can make the argument that
-// the receiveMessage should be public, but given how tied it is to google's
-// pubsub I'm ok leaving it for now.
+// The core logic of the ingester is in [receiveMessage], so we test that
+// directly here. [Start] is covered by the memory source tests in the source
+// package, since importing it here would be an import cycle.
 func TestReceiveMessage(t *testing.T) {
 
 	tests := []struct {
@@ -53,7 +51,7 @@ func TestReceiveMessage(t *testing.T) {
 			mm := newMockMsg()
 			// this method will block if no one is on the line, or if the channel
 			// isn't buffered. So keep it in its own goroutine for tests
-			go subject.receiveMessage(ctx, ScanToBytes(t, s), mm)
+			go subject.receiveMessage(ctx, ScanToBytes(t, s), MessageInfo{}, mm)
 			res := <-subject.SendChan
 
 			if tt.shouldAck {
@@ -79,7 +77,7 @@ func TestReceiveMessageWillNackOnTimeout(t *testing.T) {
 	mm := newMockMsg()
 	// this method will block if no one is on the line, or if the channel
 	// isn't buffered. So keep it in its own goroutine for tests
-	go subject.receiveMessage(ctx, ScanToBytes(t, s), mm)
+	go subject.receiveMessage(ctx, ScanToBytes(t, s), MessageInfo{}, mm)
 	<-subject.SendChan
 	select {
 	case <-time.After(time.Second * 1):
@@ -92,6 +90,180 @@ func TestReceiveMessageWillNackOnTimeout(t *testing.T) {
 	fn()
 }
 
+// Once the context is done the upserters are gone, so a message still waiting
+// to be handed over has to be nacked, or the source never gets to return.
+func TestReceiveMessageNacksAfterShutdown(t *testing.T) {
+	ctx, fn := context.WithCancel(context.Background())
+	fn()
+	subject := NewIngester(zaptest.NewLogger(t), nil)
+	mm := newMockMsg()
+
+	go subject.receiveMessage(ctx, ScanToBytes(t, newScan(1)), MessageInfo{}, mm)
+	<-mm.Done
+	assert.True(t, mm.nacked)
+	assert.False(t, mm.acked)
+}
+
+func TestReceiveMessageDeadLettersBadPayloads(t *testing.T) {
+	unknownVersion := newScan(1)
+	unknownVersion.DataVersion = 99
+
+	tests := []struct {
+		name           string
+		data           []byte
+		disabled       int
+		dlqErr         error
+		expectedReason DeadLetterReason
+		shouldAck      bool
+		shouldNack     bool
+	}{
+		{
+			name:           "malformed json is dead lettered and acked",
+			data:           []byte(`{"ip": "1.1.1.1", "port": `),
+			expectedReason: ReasonMalformedPayload,
+			shouldAck:      true,
+		},
+		{
+			name:           "unknown data version is dead lettered and acked",
+			data:           ScanToBytes(t, unknownVersion),
+			expectedReason: ReasonUnknownDataVersion,
+			shouldAck:      true,
+		},
+		{
+			name:           "disabled data version is dead lettered and acked",
+			data:           ScanToBytes(t, newScan(scanning.V1)),
+			disabled:       scanning.V1,
+			expectedReason: ReasonDisabledDataVersion,
+			shouldAck:      true,
+		},
+		{
+			name:           "failure to dead letter should nack",
+			data:           []byte(`not even close`),
+			dlqErr:         errors.New("test-error"),
+			expectedReason: ReasonMalformedPayload,
+			shouldNack:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+			defer fn()
+			l := zaptest.NewLogger(t)
+			dlq := &mockDeadLetterer{err: tt.dlqErr}
+			if tt.disabled != 0 {
+				assert.NoError(t, SetDataVersionStatus(tt.disabled, DataVersionDisabled))
+				t.Cleanup(func() { _ = SetDataVersionStatus(tt.disabled, DataVersionEnabled) })
+			}
+
+			subject := NewIngester(l, nil, WithDeadLetter(dlq))
+			mm := newMockMsg()
+			info := MessageInfo{ID: "msg-1", DeliveryAttempt: 2}
+
+			go subject.receiveMessage(ctx, tt.data, info, mm)
+			select {
+			case <-subject.SendChan:
+				assert.FailNow(t, "bad payloads should never make it to the upserter")
+			case <-mm.Done:
+			}
+
+			assert.Equal(t, tt.shouldAck, mm.acked)
+			assert.Equal(t, tt.shouldNack, mm.nacked)
+			if assert.Len(t, dlq.letters, 1) {
+				letter := dlq.letters[0]
+				assert.Equal(t, tt.data, letter.Data)
+				assert.Equal(t, tt.expectedReason, letter.Reason)
+				assert.Equal(t, "msg-1", letter.MessageID)
+				assert.Equal(t, 2, letter.DeliveryAttempt)
+				assert.Equal(t, string(tt.expectedReason), letter.Attributes()[AttributeReason])
+			}
+		})
+	}
+}
+
+func TestReceiveMessageDeadLettersPoisonScans(t *testing.T) {
+	tests := []struct {
+		name          string
+		withDLQ       bool
+		poison        bool
+		shouldAck     bool
+		shouldNack    bool
+		expectedCount int
+	}{
+		{name: "poison is dead lettered", withDLQ: true, poison: true, shouldAck: true, expectedCount: 1},
+		{name: "poison without a sink is nacked", poison: true, shouldNack: true},
+		{name: "transient failure is nacked", withDLQ: true, shouldNack: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+			defer fn()
+			dlq := &mockDeadLetterer{}
+			opts := []IngesterOption{}
+			if tt.withDLQ {
+				opts = append(opts, WithDeadLetter(dlq))
+			}
+			subject := NewIngester(zaptest.NewLogger(t), nil, opts...)
+			mm := newMockMsg()
+			data := ScanToBytes(t, newScan(1))
+
+			go subject.receiveMessage(ctx, data, MessageInfo{ID: "msg-1"}, mm)
+			res := <-subject.SendChan
+			res.Res <- messageResponse{err: errors.New("test-error"), poison: tt.poison}
+			<-mm.Done
+
+			assert.Equal(t, tt.shouldAck, mm.acked)
+			assert.Equal(t, tt.shouldNack, mm.nacked)
+			if assert.Len(t, dlq.letters, tt.expectedCount) && tt.expectedCount > 0 {
+				assert.Equal(t, ReasonUpsertFailed, dlq.letters[0].Reason)
+				assert.Equal(t, data, dlq.letters[0].Data)
+				assert.Equal(t, "test-error", dlq.letters[0].Error)
+			}
+		})
+	}
+}
+
+func TestReceiveMessageWithoutDeadLetterLeavesMessage(t *testing.T) {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	l := zaptest.NewLogger(t)
+
+	subject := NewIngester(l, nil)
+	mm := newMockMsg()
+
+	// no dead letter sink configured, so this should return without touching
+	// the message and let pubsub redeliver it.
+	subject.receiveMessage(ctx, []byte(`{`), MessageInfo{}, mm)
+	assert.False(t, mm.acked)
+	assert.False(t, mm.nacked)
+}
+
+func TestReceiveMessageRecordsMetrics(t *testing.T) {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	l := zaptest.NewLogger(t)
+	subject := NewIngester(l, nil, WithDeadLetter(&mockDeadLetterer{}))
+
+	parsed := testutil.ToFloat64(messagesParsed.WithLabelValues("2"))
+	failed := testutil.ToFloat64(messagesFailed.WithLabelValues("unknown", string(ReasonMalformedPayload)))
+	acks := testutil.ToFloat64(messageResults.WithLabelValues(resultAck))
+	deadLetters := testutil.ToFloat64(messageResults.WithLabelValues(resultDeadLetter))
+
+	mm := newMockMsg()
+	go subject.receiveMessage(ctx, ScanToBytes(t, newScan(2)), MessageInfo{}, mm)
+	res := <-subject.SendChan
+	res.Res <- messageResponse{}
+	<-mm.Done
+
+	mm = newMockMsg()
+	go subject.receiveMessage(ctx, []byte("{"), MessageInfo{}, mm)
+	<-mm.Done
+
+	assert.Equal(t, parsed+1, testutil.ToFloat64(messagesParsed.WithLabelValues("2")))
+	assert.Equal(t, failed+1, testutil.ToFloat64(messagesFailed.WithLabelValues("unknown", string(ReasonMalformedPayload))))
+	assert.Equal(t, acks+1, testutil.ToFloat64(messageResults.WithLabelValues(resultAck)))
+	assert.Equal(t, deadLetters+1, testutil.ToFloat64(messageResults.WithLabelValues(resultDeadLetter)))
+}
+
 func newScan(version int) scanning.Scan {
 	var dd interface{}
 	if version == scanning.V1 {
@@ -137,6 +309,16 @@ func (m *mockMsg) Nack() {
 	m.Done <- struct{}{}
 }
 
+type mockDeadLetterer struct {
+	err     error
+	letters []DeadLetter
+}
+
+func (m *mockDeadLetterer) DeadLetter(_ context.Context, letter DeadLetter) error {
+	m.letters = append(m.letters, letter)
+	return m.err
+}
+
 func ScanToBytes(t *testing.T, s scanning.Scan) []byte {
 	encoded, err := json.Marshal(s)
 	if err != nil {
@@ -0,0 +1,168 @@
+package ingester
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/censys/scan-takehome/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// message results, used as the result label on the message metrics.
+const (
+	resultAck        = "ack"
+	resultNack       = "nack"
+	resultTimeout    = "timeout"
+	resultDeadLetter = "dead_letter"
+)
+
+var (
+	messagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "ingester",
+		Name:      "messages_received_total",
+		Help:      "Messages received from the source, by data version.",
+	}, []string{"data_version"})
+
+	messagesParsed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "ingester",
+		Name:      "messages_parsed_total",
+		Help:      "Messages successfully decoded into a scan, by data version.",
+	}, []string{"data_version"})
+
+	messagesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "ingester",
+		Name:      "messages_failed_total",
+		Help:      "Messages that could not be decoded or failed validation, by data version and reason.",
+	}, []string{"data_version", "reason"})
+
+	scansRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "ingester",
+		Name:      "scans_rejected_total",
+		Help:      "Scans that decoded but failed validation, by data version and validation reason.",
+	}, []string{"data_version", "reason"})
+
+	messagesDeprecated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "ingester",
+		Name:      "messages_deprecated_total",
+		Help:      "Messages decoded from a data version that's marked deprecated, by data version.",
+	}, []string{"data_version"})
+
+	messageResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "ingester",
+		Name:      "message_results_total",
+		Help:      "How messages were finished off: ack, nack, timeout (nacked) or dead_letter (acked).",
+	}, []string{"result"})
+
+	messageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "ingester",
+		Name:      "message_duration_seconds",
+		Help:      "Time from handing a scan to the upserter to getting an answer back, by result.",
+		Buckets:   []float64{.01, .05, .1, .5, 1, 2.5, 5, 10, 15, 30, 60},
+	}, []string{"result"})
+
+	batchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upserter",
+		Name:      "batch_size",
+		Help:      "Number of scans in each flushed batch.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	flushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upserter",
+		Name:      "flush_duration_seconds",
+		Help:      "Time taken to flush a batch to the data store, by result: success, partial or error.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	scansSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upserter",
+		Name:      "scans_skipped_total",
+		Help:      "Scans acked without being upserted, by reason: stale (cache says we have newer) or superseded (newer scan in the same batch). They still go to the history.",
+	}, []string{"reason"})
+
+	historyFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upserter",
+		Name:      "history_failed_total",
+		Help:      "Stale or superseded scans that couldn't be recorded in the history. They've already been acked, so they aren't retried.",
+	})
+
+	rowsUpserted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upserter",
+		Name:      "rows_total",
+		Help:      "Scan results touched by flushes, by result: new, changed (different response), unchanged (same response seen again) or stale (older than what's saved).",
+	}, []string{"result"})
+
+	scansFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upserter",
+		Name:      "scans_failed_total",
+		Help:      "Scans that couldn't be saved, by kind: poison (rejected by the data store on its own) or transient (anything else, retried later).",
+	}, []string{"kind"})
+)
+
+func init() {
+	metrics.MustRegister(
+		messagesReceived,
+		messagesParsed,
+		messagesFailed,
+		messagesDeprecated,
+		scansRejected,
+		messageResults,
+		messageDuration,
+		batchSize,
+		flushDuration,
+		scansSkipped,
+		historyFailed,
+		rowsUpserted,
+		scansFailed,
+		dataVersionsCollector{},
+	)
+}
+
+// dataVersionLabel makes a best effort attempt at getting the data version out
+// of a payload that failed to decode. Versions we don't support are lumped
+// together so garbage payloads can't blow up the label cardinality.
+func dataVersionLabel(data []byte) string {
+	var peek struct {
+		DataVersion int `json:"data_version"`
+	}
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return "unknown"
+	}
+	if _, ok := decoders.status(peek.DataVersion); !ok {
+		return "unknown"
+	}
+	return strconv.Itoa(peek.DataVersion)
+}
+
+// dataVersionsCollector exports the status of every registered data version,
+// read from the registry at scrape time so it's always current.
+type dataVersionsCollector struct{}
+
+var dataVersionsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metrics.Namespace, "ingester", "data_versions"),
+	"Registered data versions, by status: enabled, deprecated or disabled. Always 1.",
+	[]string{"data_version", "status"}, nil,
+)
+
+func (dataVersionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dataVersionsDesc
+}
+
+func (dataVersionsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, v := range decoders.all() {
+		ch <- prometheus.MustNewConstMetric(dataVersionsDesc, prometheus.GaugeValue, 1, strconv.Itoa(v.Version), v.Status.String())
+	}
+}
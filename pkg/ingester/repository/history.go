@@ -0,0 +1,262 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/censys/scan-takehome/pkg/scanning"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const historyPartitionPrefix = "scan_history_p"
+
+// HistoryRecord is a single observation of a service.
+type HistoryRecord struct {
+	Ip                string                 `json:"ip"`
+	Port              uint32                 `json:"port"`
+	Transport         string                 `json:"transport"`
+	Service           string                 `json:"service"`
+	Response          string                 `json:"response"`
+	ResponseRaw       []byte                 `json:"response_raw"`
+	ResponseValidUTF8 bool                   `json:"response_valid_utf8"`
+	Protocol          *scanning.ProtocolData `json:"protocol,omitempty"`
+	ObservedAt        time.Time              `json:"observed_at"`
+}
+
+// HistoryQuery selects the observations for a single ip/port/transport/service.
+// From and To are inclusive, and a zero value leaves that end of the range
+// open. An empty transport is tcp.
+type HistoryQuery struct {
+	Ip        string
+	Port      uint32
+	Transport string
+	Service   string
+	From      time.Time
+	To        time.Time
+	// Limit caps the number of records returned. Zero means no limit.
+	Limit int
+}
+
+// History returns the observations matching the query, newest first.
+func (r *PostgresRespository) History(ctx context.Context, q HistoryQuery) ([]HistoryRecord, error) {
+	var from, to *time.Time
+	if !q.From.IsZero() {
+		t := q.From.UTC()
+		from = &t
+	}
+	if !q.To.IsZero() {
+		t := q.To.UTC()
+		to = &t
+	}
+	var limit *int
+	if q.Limit > 0 {
+		limit = &q.Limit
+	}
+
+	rows, err := r.conn.Query(ctx, `
+		SELECT host(ip), port, transport, service, response, response_raw, response_valid_utf8, protocol, observed_at
+		FROM scan_history
+		WHERE ip = $1 AND port = $2 AND transport = $3 AND service = $4
+			AND ($5::timestamp IS NULL OR observed_at >= $5)
+			AND ($6::timestamp IS NULL OR observed_at <= $6)
+		ORDER BY observed_at DESC
+		LIMIT $7
+	`, lookupIP(q.Ip), int(q.Port), ingester.NormalizeTransport(q.Transport), q.Service, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanHistoryRecord)
+}
+
+// HistoryAt returns the observation that was current at the provided time,
+// ie. the newest one at or before it. Returns nil if the service hadn't been
+// seen yet (or the history has been pruned).
+func (r *PostgresRespository) HistoryAt(ctx context.Context, ip string, port uint32, transport, service string, at time.Time) (*HistoryRecord, error) {
+	records, err := r.History(ctx, HistoryQuery{
+		Ip:        ip,
+		Port:      port,
+		Transport: transport,
+		Service:   service,
+		To:        at,
+		Limit:     1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return &records[0], nil
+}
+
+// PruneHistory drops every history partition that only holds observations
+// older than the retention period. Returns the number of partitions dropped.
+func (r *PostgresRespository) PruneHistory(ctx context.Context, retention time.Duration) (int, error) {
+	cutoff := time.Now().UTC().Add(-retention)
+
+	rows, err := r.conn.Query(ctx, `
+		SELECT c.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = 'scan_history'
+	`)
+	if err != nil {
+		return 0, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+
+	dropped := 0
+	for _, name := range names {
+		month, ok := partitionMonth(name)
+		if !ok || !partitionExpired(month, cutoff) {
+			continue
+		}
+		if _, err := r.conn.Exec(ctx, "DROP TABLE IF EXISTS "+pgx.Identifier{name}.Sanitize()); err != nil {
+			return dropped, err
+		}
+		r.partitions.Delete(month)
+		dropped++
+	}
+	return dropped, nil
+}
+
+// RecordHistory records scans in scan_history without touching scan_results,
+// for scans the upserter already knows can't change the latest results.
+func (r *PostgresRespository) RecordHistory(ctx context.Context, scans []ingester.Scan) error {
+	if len(scans) == 0 {
+		return nil
+	}
+	rows, err := newUpsertRows(scans)
+	if err != nil {
+		return err
+	}
+	history := r.historyRows(rows, time.Now())
+	err = r.recordHistory(ctx, history)
+	if missingHistoryPartition(err) {
+		r.forgetPartitions()
+		err = r.recordHistory(ctx, history)
+	}
+	return err
+}
+
+func (r *PostgresRespository) recordHistory(ctx context.Context, history *upsertRows) error {
+	if err := r.ensureHistoryPartitions(ctx, history.timestamps); err != nil {
+		return err
+	}
+	return r.insertHistory(ctx, r.conn, history)
+}
+
+// historyRows picks out the observations that belong in scan_history: anything
+// in a partition that PruneHistory has dropped (or would drop) is left out, as
+// is anything more than a month into the future, so stray timestamps can't
+// create partitions nobody will ever look at. Both still count towards the
+// latest results.
+func (r *PostgresRespository) historyRows(rows *upsertRows, now time.Time) *upsertRows {
+	latestMonth := monthStart(now).AddDate(0, 1, 0)
+	keep := make([]int, 0, len(rows.timestamps))
+	for i, ts := range rows.timestamps {
+		month := monthStart(ts)
+		if r.historyRetention > 0 && partitionExpired(month, now.Add(-r.historyRetention)) {
+			continue
+		}
+		if month.After(latestMonth) {
+			continue
+		}
+		keep = append(keep, i)
+	}
+	if dropped := len(rows.timestamps) - len(keep); dropped > 0 {
+		historyDropped.Add(float64(dropped))
+	}
+	if len(keep) == len(rows.timestamps) {
+		return rows
+	}
+	return rows.pick(keep)
+}
+
+// partitionExpired is whether the partition for month only holds observations
+// from before the cutoff.
+func partitionExpired(month, cutoff time.Time) bool {
+	return month.AddDate(0, 1, 0).Before(cutoff)
+}
+
+// ensureHistoryPartitions creates the monthly partitions needed to hold the
+// provided timestamps, if they don't exist already.
+func (r *PostgresRespository) ensureHistoryPartitions(ctx context.Context, timestamps []time.Time) error {
+	for _, ts := range timestamps {
+		month := monthStart(ts)
+		if _, ok := r.partitions.Load(month); ok {
+			continue
+		}
+
+		_, err := r.conn.Exec(ctx, fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s PARTITION OF scan_history FOR VALUES FROM ('%s') TO ('%s')",
+			pgx.Identifier{partitionName(month)}.Sanitize(),
+			month.Format(time.DateOnly),
+			month.AddDate(0, 1, 0).Format(time.DateOnly),
+		))
+		// IF NOT EXISTS isn't safe against another worker creating the same
+		// partition at the same time. Either way, the partition is there.
+		var pgErr *pgconn.PgError
+		if err != nil && !(errors.As(err, &pgErr) && (pgErr.Code == "42P07" || pgErr.Code == "23505")) {
+			return fmt.Errorf("failed to create history partition: %w", err)
+		}
+		r.partitions.Store(month, struct{}{})
+	}
+	return nil
+}
+
+// missingHistoryPartition is whether err is postgres finding no scan_history
+// partition for a row. The partitions we know about are only known to this
+// process, so it happens when another replica prunes one we still think is
+// there.
+func missingHistoryPartition(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23514" && pgErr.TableName == "scan_history"
+}
+
+// forgetPartitions clears the partitions we know exist, so the next write
+// checks them all again. Anything that's since expired is left out by
+// historyRows rather than created again.
+func (r *PostgresRespository) forgetPartitions() {
+	r.partitions.Clear()
+}
+
+func scanHistoryRecord(row pgx.CollectableRow) (HistoryRecord, error) {
+	var rec HistoryRecord
+	var port int
+	err := row.Scan(&rec.Ip, &port, &rec.Transport, &rec.Service, &rec.Response, &rec.ResponseRaw, &rec.ResponseValidUTF8, &rec.Protocol, &rec.ObservedAt)
+	rec.Port = uint32(port)
+	return rec, err
+}
+
+// monthStart truncates the time to the first of its month, in UTC.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func partitionName(month time.Time) string {
+	return historyPartitionPrefix + month.Format("200601")
+}
+
+// partitionMonth parses the month back out of a partition name.
+func partitionMonth(name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(name, historyPartitionPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	month, err := time.Parse("200601", suffix)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return month, true
+}
@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/censys/scan-takehome/pkg/scanning"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionNames(t *testing.T) {
+	ts := time.Date(2025, time.March, 31, 23, 59, 59, 0, time.UTC)
+	month := monthStart(ts)
+	assert.Equal(t, time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC), month)
+	assert.Equal(t, "scan_history_p202503", partitionName(month))
+
+	parsed, ok := partitionMonth(partitionName(month))
+	assert.True(t, ok)
+	assert.Equal(t, month, parsed)
+
+	// times in other zones land in the partition for their UTC month
+	est := time.FixedZone("EST", -5*60*60)
+	assert.Equal(t, time.Date(2025, time.April, 1, 0, 0, 0, 0, time.UTC),
+		monthStart(time.Date(2025, time.March, 31, 22, 0, 0, 0, est)))
+
+	for _, name := range []string{"scan_history", "scan_history_p2025", "scan_history_pabcdef", "scan_results"} {
+		_, ok := partitionMonth(name)
+		assert.False(t, ok, "%s should not parse as a partition", name)
+	}
+}
+
+func TestUpsertRecordsEveryObservationInHistory(t *testing.T) {
+	now := time.Date(2025, time.June, 15, 12, 0, 0, 0, time.UTC)
+	scan := func(ts time.Time, response string) ingester.Scan {
+		return ingester.Scan{
+			Scan:     scanning.Scan{Ip: "1.1.1.1", Port: 53, Service: "DNS", Timestamp: ts.Unix()},
+			Response: response,
+		}
+	}
+	// without a cache in front, older scans for a key come along with the
+	// newest and still belong in the history.
+	rows, err := newUpsertRows([]ingester.Scan{
+		scan(now, "newest"),
+		scan(now.Add(-time.Minute), "superseded"),
+		scan(now.Add(-time.Hour), "stale"),
+	})
+	assert.NoError(t, err)
+
+	subject := NewPostgresRepository(nil, WithHistoryRetention(time.Hour*24*90))
+	assert.Equal(t, []string{"newest"}, rows.latest().responses)
+	assert.Equal(t, []string{"newest", "superseded", "stale"}, subject.historyRows(rows, now).responses)
+}
+
+func TestHistoryRowsStayOutOfPrunedPartitions(t *testing.T) {
+	now := time.Date(2025, time.June, 15, 12, 0, 0, 0, time.UTC)
+	retention := time.Hour * 24 * 90
+	cutoff := now.Add(-retention)
+	tests := []struct {
+		name string
+		ts   time.Time
+		keep bool
+	}{
+		{name: "now", ts: now, keep: true},
+		{name: "start of the oldest kept month", ts: monthStart(cutoff), keep: true},
+		{name: "end of the newest pruned month", ts: monthStart(cutoff).Add(-time.Second)},
+		{name: "far past", ts: time.Unix(0, 0)},
+		{name: "next month", ts: monthStart(now).AddDate(0, 1, 5), keep: true},
+		{name: "far future", ts: now.AddDate(5, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := newUpsertRows([]ingester.Scan{{Scan: scanning.Scan{Ip: "1.1.1.1", Port: 53, Service: "DNS", Timestamp: tt.ts.Unix()}}})
+			assert.NoError(t, err)
+
+			subject := NewPostgresRepository(nil, WithHistoryRetention(retention))
+			history := subject.historyRows(rows, now)
+			if !tt.keep {
+				assert.Empty(t, history.timestamps, "a partition PruneHistory drops must never be recreated")
+				return
+			}
+			if assert.Len(t, history.timestamps, 1) {
+				assert.False(t, partitionExpired(monthStart(history.timestamps[0]), cutoff), "PruneHistory would drop a partition we just wrote to")
+			}
+		})
+	}
+
+	// without a retention nothing is pruned, so the past is all fair game.
+	rows, err := newUpsertRows([]ingester.Scan{{Scan: scanning.Scan{Ip: "1.1.1.1", Port: 53, Service: "DNS", Timestamp: 0}}})
+	assert.NoError(t, err)
+	assert.Len(t, NewPostgresRepository(nil).historyRows(rows, now).timestamps, 1)
+}
+
+// Another replica pruning a partition leaves ours thinking it still exists.
+// Forgetting them means the next write checks again.
+func TestForgetPartitions(t *testing.T) {
+	subject := NewPostgresRepository(nil)
+	month := monthStart(time.Now())
+	subject.partitions.Store(month, struct{}{})
+	assert.True(t, missingHistoryPartition(fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "23514", TableName: "scan_history"})))
+	assert.False(t, missingHistoryPartition(&pgconn.PgError{Code: "23505", TableName: "scan_history"}))
+
+	subject.forgetPartitions()
+	_, ok := subject.partitions.Load(month)
+	assert.False(t, ok)
+}
@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"github.com/censys/scan-takehome/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	upsertDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "repository",
+		Name:      "upsert_duration_seconds",
+		Help:      "Time taken by UpsertMany, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	upsertErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "repository",
+		Name:      "upsert_errors_total",
+		Help:      "UpsertMany calls that failed.",
+	})
+
+	scansUpserted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "repository",
+		Name:      "scans_upserted_total",
+		Help:      "Scans passed to successful UpsertMany calls.",
+	})
+
+	historyDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "repository",
+		Name:      "history_dropped_total",
+		Help:      "Observations left out of scan_history for being outside the retention period or too far in the future.",
+	})
+
+	eventsPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "repository",
+		Name:      "events_published_total",
+		Help:      "Change events published, by type.",
+	}, []string{"type"})
+
+	eventPublishErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "repository",
+		Name:      "event_publish_errors_total",
+		Help:      "Batches of change events that failed to publish from the outbox, to be retried.",
+	})
+)
+
+func init() {
+	metrics.MustRegister(upsertDuration, upsertErrors, scansUpserted, historyDropped, eventsPublished, eventPublishErrors)
+}
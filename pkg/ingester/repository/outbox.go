@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/jackc/pgx/v5"
+)
+
+// outboxBatchSize is how many events PublishOutbox hands to the publisher at
+// a time.
+const outboxBatchSize = 500
+
+// PublishOutbox sends the change events waiting in the outbox on to the
+// publisher, oldest first, and deletes them once it has accepted them. Rows
+// are locked while they're being published so replicas draining at the same
+// time skip past each other. If the publish works but the delete doesn't, the
+// events go out again next time, so delivery is at least once. Returns how
+// many events were published.
+func (r *PostgresRespository) PublishOutbox(ctx context.Context) (int, error) {
+	if r.publisher == nil {
+		return 0, nil
+	}
+	published := 0
+	for {
+		n, err := r.publishOutboxBatch(ctx)
+		published += n
+		if err != nil || n < outboxBatchSize {
+			return published, err
+		}
+	}
+}
+
+func (r *PostgresRespository) publishOutboxBatch(ctx context.Context) (int, error) {
+	var published int
+	err := pgx.BeginFunc(ctx, r.conn, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			SELECT id::text, event FROM change_event_outbox
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		`, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		var events []ingester.ChangeEvent
+		var id string
+		var doc []byte
+		_, err = pgx.ForEachRow(rows, []any{&id, &doc}, func() error {
+			// a fresh event each time, unmarshalling over the last one would
+			// keep any fields this one leaves out.
+			var event ingester.ChangeEvent
+			if err := json.Unmarshal(doc, &event); err != nil {
+				return fmt.Errorf("bad change event %s in the outbox: %w", id, err)
+			}
+			ids = append(ids, id)
+			events = append(events, event)
+			return nil
+		})
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		if err := r.publisher.Publish(ctx, events); err != nil {
+			eventPublishErrors.Inc()
+			return fmt.Errorf("failed to publish change events: %w", err)
+		}
+		for _, event := range events {
+			eventsPublished.WithLabelValues(string(event.Type)).Inc()
+		}
+		published = len(events)
+		_, err = tx.Exec(ctx, `DELETE FROM change_event_outbox WHERE id = ANY($1::uuid[])`, ids)
+		return err
+	})
+	return published, err
+}
+
+// OutboxReady is signalled whenever an upsert commits new events to the
+// outbox, so they can be published without waiting for the next poll.
+func (r *PostgresRespository) OutboxReady() <-chan struct{} {
+	return r.outboxReady
+}
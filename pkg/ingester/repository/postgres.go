@@ -2,61 +2,398 @@ package repository
 
 import (
 	"context"
-	"net"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type PostgresRespository struct {
 	conn *pgxpool.Pool
+	// publisher gets the change events for each upsert, when set. They go
+	// through the outbox, see PublishOutbox.
+	publisher   ingester.EventPublisher
+	outboxReady chan struct{}
+	// historyRetention is how long observations are kept in scan_history,
+	// zero keeps everything.
+	historyRetention time.Duration
+	// history partitions we know exist, keyed on the start of the month.
+	partitions sync.Map
 }
 
-func (r *PostgresRespository) UpsertMany(ctx context.Context, scans []ingester.Scan) error {
+// UpsertMany saves the latest response for each scan to scan_results, and
+// records every scan in scan_history. Both happen in a single transaction,
+// along with queueing a change event in the outbox for every service that is
+// new or has a different response, when there is a publisher (see
+// [WithEventPublisher] and [PostgresRespository.PublishOutbox]).
+func (r *PostgresRespository) UpsertMany(ctx context.Context, scans []ingester.Scan) (ingester.UpsertStats, error) {
 	if len(scans) == 0 {
-		return nil
+		return ingester.UpsertStats{}, nil
 	}
 
-	ips := make([]net.IP, len(scans))
-	ports := make([]int, len(scans))
-	timestamps := make([]time.Time, len(scans))
-	services := make([]string, len(scans))
-	responses := make([]string, len(scans))
-
-	for i, scan := range scans {
-		ips[i] = net.ParseIP(scan.Ip)
-		timestamps[i] = scan.Time()
-		services[i] = scan.Service
-		ports[i] = int(scan.Port)
-		responses[i] = scan.Response
-	}
-
-	// include the conflict and where timestamp check on the upsert for general safety.
-	// There is no hard requirement for there to be a cache in front of the database,
-	// although it would be useful.
-	_, err := r.conn.Exec(ctx, `
-		INSERT INTO scan_results (ip, port, service, response, last_seen)
-		SELECT * FROM
-			 UNNEST($1::inet[], $2::int[], $3::text[], $4::text[], $5::timestamp[])
-		ON CONFLICT ON CONSTRAINT ip_port_service
-		DO UPDATE SET
-			ip = EXCLUDED.ip,
-			port = EXCLUDED.port,
-			service = EXCLUDED.service,
-			response = EXCLUDED.response,
-			last_seen = EXCLUDED.last_seen
-		WHERE EXCLUDED.last_seen > scan_results.last_seen
-	`, ips, ports, services, responses, timestamps)
+	start := time.Now()
+	stats, err := r.upsertMany(ctx, scans)
+	if missingHistoryPartition(err) {
+		// another replica pruned a partition we thought was still there.
+		r.forgetPartitions()
+		stats, err = r.upsertMany(ctx, scans)
+	}
+	if err != nil {
+		upsertErrors.Inc()
+		upsertDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+		return ingester.UpsertStats{}, classifyError(err)
+	}
+	upsertDuration.WithLabelValues("success").Observe(time.Since(start).Seconds())
+	scansUpserted.Add(float64(len(scans)))
+	return stats, nil
+}
 
+func (r *PostgresRespository) upsertMany(ctx context.Context, scans []ingester.Scan) (ingester.UpsertStats, error) {
+	var stats ingester.UpsertStats
+	var events []ingester.ChangeEvent
+	rows, err := newUpsertRows(scans)
 	if err != nil {
+		return stats, err
+	}
+	latest := rows.latest()
+	history := r.historyRows(rows, time.Now())
+
+	// partitions are DDL, keep them out of the transaction so a failed batch
+	// doesn't throw away a partition another worker is about to need.
+	if err := r.ensureHistoryPartitions(ctx, history.timestamps); err != nil {
+		return stats, err
+	}
+
+	err = pgx.BeginFunc(ctx, r.conn, func(tx pgx.Tx) error {
+		stats = ingester.UpsertStats{}
+		// include the conflict and where timestamp check on the upsert for general safety.
+		// There is no hard requirement for there to be a cache in front of the database,
+		// although it would be useful.
+		//
+		// A newer scan only replaces the response when the hash is different,
+		// otherwise it's just another sighting. Returning the old and new hash
+		// tells them apart: there is no old row for inserts, and the hash
+		// only moves when the response changed. Stale scans don't come back
+		// at all.
+		results, err := tx.Query(ctx, `
+			INSERT INTO scan_results AS r (ip, port, transport, service, response, response_raw, response_valid_utf8, protocol, last_seen,
+				response_hash, first_seen, last_changed, seen_count)
+			SELECT ip, port, transport, service, response, response_raw, response_valid_utf8, NULLIF(protocol, '')::jsonb, last_seen,
+				response_hash, last_seen, last_seen, 1 FROM
+				 UNNEST($1::inet[], $2::int[], $3::text[], $4::text[], $5::text[], $6::bytea[], $7::bool[], $8::text[], $9::timestamp[], $10::bytea[])
+				 AS t(ip, port, transport, service, response, response_raw, response_valid_utf8, protocol, last_seen, response_hash)
+			ON CONFLICT ON CONSTRAINT ip_port_transport_service
+			DO UPDATE SET
+				response = CASE WHEN r.response_hash = EXCLUDED.response_hash THEN r.response ELSE EXCLUDED.response END,
+				response_raw = CASE WHEN r.response_hash = EXCLUDED.response_hash THEN r.response_raw ELSE EXCLUDED.response_raw END,
+				response_valid_utf8 = CASE WHEN r.response_hash = EXCLUDED.response_hash THEN r.response_valid_utf8 ELSE EXCLUDED.response_valid_utf8 END,
+				protocol = CASE WHEN r.response_hash = EXCLUDED.response_hash THEN r.protocol ELSE EXCLUDED.protocol END,
+				response_hash = EXCLUDED.response_hash,
+				last_changed = CASE WHEN r.response_hash = EXCLUDED.response_hash THEN r.last_changed ELSE EXCLUDED.last_seen END,
+				seen_count = r.seen_count + 1,
+				last_seen = EXCLUDED.last_seen
+			WHERE EXCLUDED.last_seen > r.last_seen
+			RETURNING host(new.ip), new.port, new.transport, new.service, new.response, new.last_seen,
+				encode(old.response_hash, 'hex'), encode(new.response_hash, 'hex')
+		`, append(latest.args(), latest.hashes)...)
+		if err != nil {
+			return err
+		}
+		events = events[:0]
+		var row upsertedRow
+		_, err = pgx.ForEachRow(results, row.scanTargets(), func() error {
+			event, ok := row.event()
+			switch {
+			case !ok:
+				stats.Unchanged++
+			case event.Type == ingester.EventServiceDiscovered:
+				stats.New++
+			default:
+				stats.Changed++
+			}
+			if ok {
+				events = append(events, event)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		stats.Stale = len(latest.ips) - stats.New - stats.Changed - stats.Unchanged
+
+		if err := r.insertHistory(ctx, tx, history); err != nil {
+			return err
+		}
+
+		// the events are only published once this commits, so there's
+		// never an event for a change that didn't save.
+		return r.queueEvents(ctx, tx, events)
+	})
+	if err == nil && r.publisher != nil && len(events) > 0 {
+		select {
+		case r.outboxReady <- struct{}{}:
+		default:
+			// the relay already has a wake up waiting.
+		}
+	}
+	return stats, err
+}
+
+// insertHistory records every observation in scan_history. Redelivered
+// messages will show up again, only the first is kept.
+func (r *PostgresRespository) insertHistory(ctx context.Context, conn execer, history *upsertRows) error {
+	if len(history.ips) == 0 {
+		return nil
+	}
+	_, err := conn.Exec(ctx, `
+		INSERT INTO scan_history (ip, port, transport, service, response, response_raw, response_valid_utf8, protocol, observed_at)
+		SELECT ip, port, transport, service, response, response_raw, response_valid_utf8, NULLIF(protocol, '')::jsonb, observed_at FROM
+			 UNNEST($1::inet[], $2::int[], $3::text[], $4::text[], $5::text[], $6::bytea[], $7::bool[], $8::text[], $9::timestamp[])
+			 AS t(ip, port, transport, service, response, response_raw, response_valid_utf8, protocol, observed_at)
+		ON CONFLICT ON CONSTRAINT scan_history_observation DO NOTHING
+	`, history.args()...)
+	return err
+}
+
+// queueEvents writes the change events to the outbox as part of the upsert's
+// transaction, in the order they came back from the upsert.
+func (r *PostgresRespository) queueEvents(ctx context.Context, tx pgx.Tx, events []ingester.ChangeEvent) error {
+	if r.publisher == nil || len(events) == 0 {
+		return nil
+	}
+	docs := make([]string, len(events))
+	for i, event := range events {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		docs[i] = string(b)
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO change_event_outbox (event)
+		SELECT event FROM unnest($1::jsonb[]) WITH ORDINALITY AS t(event, n)
+		ORDER BY n
+	`, docs)
+	return err
+}
+
+// execer is a pool or a transaction.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// upsertedRow is a row returned by the scan_results upsert.
+type upsertedRow struct {
+	ip           string
+	port         int
+	transport    string
+	service      string
+	response     string
+	lastSeen     time.Time
+	previousHash *string
+	hash         string
+}
+
+func (u *upsertedRow) scanTargets() []any {
+	return []any{&u.ip, &u.port, &u.transport, &u.service, &u.response, &u.lastSeen, &u.previousHash, &u.hash}
+}
+
+// event is the change event for the row, if it's new or the response changed.
+func (u *upsertedRow) event() (ingester.ChangeEvent, bool) {
+	event := ingester.ChangeEvent{
+		Type:         ingester.EventServiceDiscovered,
+		Ip:           u.ip,
+		Port:         uint32(u.port),
+		Transport:    u.transport,
+		Service:      u.service,
+		ResponseHash: u.hash,
+		Response:     u.response,
+		ObservedAt:   u.lastSeen,
+	}
+	if u.previousHash != nil {
+		if *u.previousHash == u.hash {
+			return ingester.ChangeEvent{}, false
+		}
+		event.Type = ingester.EventServiceChanged
+		event.PreviousResponseHash = *u.previousHash
+	}
+	return event, true
+}
+
+// classifyError marks data exceptions (22) and integrity constraint
+// violations (23) with [ingester.ErrRecordRejected], since those are down to
+// what's in the rows and will fail every time. Everything else, like a lost
+// connection or a timeout, might work on a retry. A missing history partition
+// is a check violation too, but it's down to the partitions rather than the
+// rows.
+func classifyError(err error) error {
+	var pgErr *pgconn.PgError
+	if missingHistoryPartition(err) {
 		return err
 	}
-	return nil
+	if errors.As(err, &pgErr) && (strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")) {
+		return fmt.Errorf("%w: %w", ingester.ErrRecordRejected, err)
+	}
+	return err
+}
+
+// upsertRows is a batch of scans split up into columns, for UNNEST.
+type upsertRows struct {
+	ips        []netip.Addr
+	ports      []int
+	transports []string
+	services   []string
+	responses  []string
+	raws       [][]byte
+	valid      []bool
+	// json for the jsonb column, empty for scans without a protocol section.
+	protocols  []string
+	timestamps []time.Time
+	// fingerprint of the response, see responseHash. Only used for
+	// scan_results.
+	hashes [][]byte
+}
+
+func newUpsertRows(scans []ingester.Scan) (*upsertRows, error) {
+	rows := &upsertRows{}
+	for _, scan := range scans {
+		ip, err := ingester.ParseIP(scan.Ip)
+		if err != nil {
+			return nil, fmt.Errorf("%w: scan for %s has a bad ip: %w", ingester.ErrRecordRejected, scan.Key(), err)
+		}
+		var protocol string
+		if scan.Protocol != nil {
+			b, err := json.Marshal(scan.Protocol)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ingester.ErrRecordRejected, err)
+			}
+			protocol = string(b)
+		}
+		rows.ips = append(rows.ips, ip)
+		rows.ports = append(rows.ports, int(scan.Port))
+		rows.transports = append(rows.transports, ingester.NormalizeTransport(scan.Transport))
+		rows.services = append(rows.services, scan.Service)
+		rows.responses = append(rows.responses, scan.Response)
+		rows.raws = append(rows.raws, scan.ResponseRaw)
+		rows.valid = append(rows.valid, scan.ResponseValidUTF8)
+		rows.protocols = append(rows.protocols, protocol)
+		rows.timestamps = append(rows.timestamps, scan.Time().UTC())
+		rows.hashes = append(rows.hashes, responseHash(scan.ResponseRaw))
+	}
+	return rows, nil
+}
+
+// responseHash fingerprints the response. It has to match what the
+// track_response_changes migration backfilled, sha256(response_raw). The
+// protocol data is left out: it's parsed from the response, and carries things
+// that differ on every scan (dns ttls) which would make every rescan a change.
+func responseHash(raw []byte) []byte {
+	sum := sha256.Sum256(raw)
+	return sum[:]
+}
+
+// latest keeps the newest row for each ip/port/transport/service. An upsert can't touch
+// the same row twice, and two spellings of the same address are the same row.
+func (u *upsertRows) latest() *upsertRows {
+	type rowKey struct {
+		ip        netip.Addr
+		port      int
+		transport string
+		service   string
+	}
+	newest := make(map[rowKey]int, len(u.ips))
+	order := make([]rowKey, 0, len(u.ips))
+	for i := range u.ips {
+		key := rowKey{ip: u.ips[i], port: u.ports[i], transport: u.transports[i], service: u.services[i]}
+		j, ok := newest[key]
+		switch {
+		case !ok:
+			newest[key] = i
+			order = append(order, key)
+		case u.timestamps[i].After(u.timestamps[j]):
+			newest[key] = i
+		}
+	}
+	if len(order) == len(u.ips) {
+		return u
+	}
+	idx := make([]int, len(order))
+	for i, key := range order {
+		idx[i] = newest[key]
+	}
+	return u.pick(idx)
 }
 
-func NewPostgresRepository(conn *pgxpool.Pool) *PostgresRespository {
-	return &PostgresRespository{
-		conn: conn,
+// pick returns the rows at the provided indexes.
+func (u *upsertRows) pick(idx []int) *upsertRows {
+	out := &upsertRows{}
+	for _, i := range idx {
+		out.ips = append(out.ips, u.ips[i])
+		out.ports = append(out.ports, u.ports[i])
+		out.transports = append(out.transports, u.transports[i])
+		out.services = append(out.services, u.services[i])
+		out.responses = append(out.responses, u.responses[i])
+		out.raws = append(out.raws, u.raws[i])
+		out.valid = append(out.valid, u.valid[i])
+		out.protocols = append(out.protocols, u.protocols[i])
+		out.timestamps = append(out.timestamps, u.timestamps[i])
+		out.hashes = append(out.hashes, u.hashes[i])
+	}
+	return out
+}
+
+// args are the columns in the order the UNNEST in the upserts expects them.
+// The hashes only go to scan_results, so they're left for it to add on the
+// end.
+func (u *upsertRows) args() []any {
+	return []any{u.ips, u.ports, u.transports, u.services, u.responses, u.raws, u.valid, u.protocols, u.timestamps}
+}
+
+// lookupIP is the ip to look rows up by. Ips are stored unmapped, so ipv4
+// mapped addresses have to be unmapped to match. Anything that doesn't parse
+// becomes NULL, which matches nothing.
+func lookupIP(ip string) netip.Addr {
+	addr, _ := ingester.ParseIP(ip)
+	return addr
+}
+
+// RepositoryOption provides additional configuration for the [PostgresRespository]
+type RepositoryOption func(*PostgresRespository)
+
+// WithEventPublisher publishes change events for the services each upsert
+// discovers or sees change. Events wait in the outbox until
+// [PostgresRespository.PublishOutbox] sends them on.
+func WithEventPublisher(publisher ingester.EventPublisher) RepositoryOption {
+	return func(r *PostgresRespository) {
+		r.publisher = publisher
+	}
+}
+
+// WithHistoryRetention keeps observations older than the retention out of
+// scan_history, matching what [PostgresRespository.PruneHistory] drops. Without
+// it, late scans would recreate partitions that have already been pruned.
+func WithHistoryRetention(retention time.Duration) RepositoryOption {
+	return func(r *PostgresRespository) {
+		r.historyRetention = retention
+	}
+}
+
+func NewPostgresRepository(conn *pgxpool.Pool, opts ...RepositoryOption) *PostgresRespository {
+	r := &PostgresRespository{
+		conn:        conn,
+		outboxReady: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
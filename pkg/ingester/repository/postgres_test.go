@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/censys/scan-takehome/pkg/scanning"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpsertRowsCollapseIPSpellings(t *testing.T) {
+	scan := func(ip string, ts int64, response string) ingester.Scan {
+		return ingester.Scan{
+			Scan:     scanning.Scan{Ip: ip, Port: 53, Service: "DNS", Timestamp: ts},
+			Response: response,
+		}
+	}
+	rows, err := newUpsertRows([]ingester.Scan{
+		scan("2606:4700:4700:0000:0000:0000:0000:1111", 100, "expanded"),
+		scan("1.1.1.1", 100, "ipv4"),
+		scan("2606:4700:4700::1111", 300, "compressed"),
+		scan("::ffff:1.1.1.1", 200, "mapped"),
+		scan("2606:4700:4700::1111", 200, "compressed but older"),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, rows.ips, 5, "every observation goes into the history")
+	assert.Equal(t, netip.MustParseAddr("1.1.1.1"), rows.ips[3], "mapped addresses are stored as ipv4")
+
+	latest := rows.latest()
+	assert.Equal(t, []netip.Addr{
+		netip.MustParseAddr("2606:4700:4700::1111"),
+		netip.MustParseAddr("1.1.1.1"),
+	}, latest.ips)
+	assert.Equal(t, []string{"compressed", "mapped"}, latest.responses, "the newest scan for each row wins")
+	assert.Len(t, latest.args(), 9)
+
+	for _, ip := range []string{"1.1.1", "2606:4700:4700::1111%eth0"} {
+		_, err = newUpsertRows([]ingester.Scan{scan(ip, 100, "")})
+		assert.ErrorIs(t, err, ingester.ErrRecordRejected, "a bad ip fails the batch instead of inserting NULL")
+	}
+}
+
+func TestUpsertRowsKeepTransportsApart(t *testing.T) {
+	scan := func(transport string) ingester.Scan {
+		return ingester.Scan{Scan: scanning.Scan{Ip: "1.1.1.1", Port: 53, Transport: transport, Service: "DNS", Timestamp: 100}}
+	}
+	rows, err := newUpsertRows([]ingester.Scan{scan(""), scan("udp"), scan("tcp")})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tcp", "udp", "tcp"}, rows.transports, "a missing transport is tcp")
+	assert.Equal(t, []string{"tcp", "udp"}, rows.latest().transports)
+}
+
+func TestUpsertRowsHashResponses(t *testing.T) {
+	scan := func(port uint32, raw string) ingester.Scan {
+		return ingester.Scan{Scan: scanning.Scan{Ip: "1.1.1.1", Port: port, Service: "HTTP", Timestamp: 100}, ResponseRaw: []byte(raw)}
+	}
+	rows, err := newUpsertRows([]ingester.Scan{scan(80, "HTTP/1.1 200 OK"), scan(81, "HTTP/1.1 200 OK"), scan(82, "HTTP/1.1 404 Not Found")})
+	assert.NoError(t, err)
+	if assert.Len(t, rows.hashes, 3) {
+		expected := sha256.Sum256([]byte("HTTP/1.1 200 OK"))
+		assert.Equal(t, expected[:], rows.hashes[0])
+		assert.Equal(t, rows.hashes[0], rows.hashes[1], "the same response has the same hash")
+		assert.NotEqual(t, rows.hashes[0], rows.hashes[2])
+	}
+	assert.Len(t, rows.latest().hashes, 3)
+}
+
+// The protocol data comes from the response, and a rescan gets a new dns ttl
+// every time, so it's kept out of the hash.
+func TestUpsertRowsHashIgnoresProtocolData(t *testing.T) {
+	scan := func(port uint32, ttl uint32) ingester.Scan {
+		return ingester.Scan{
+			Scan:        scanning.Scan{Ip: "1.1.1.1", Port: port, Service: "DNS", Timestamp: 100},
+			ResponseRaw: []byte("NOERROR"),
+			Protocol: &scanning.ProtocolData{DNS: &scanning.DNSData{Answers: []scanning.DNSAnswer{
+				{Name: "example.com", Type: "A", TTL: ttl, Data: "93.184.216.34"},
+			}}},
+		}
+	}
+	rows, err := newUpsertRows([]ingester.Scan{scan(53, 300), scan(54, 17)})
+	assert.NoError(t, err)
+	if assert.Len(t, rows.hashes, 2) {
+		assert.Equal(t, rows.hashes[0], rows.hashes[1], "only the protocol data differs, so nothing changed")
+		// the same as the migration backfilled, sha256(response_raw)
+		rawOnly := sha256.Sum256([]byte("NOERROR"))
+		assert.Equal(t, rawOnly[:], rows.hashes[0])
+	}
+}
+
+func TestUpsertedRowEvent(t *testing.T) {
+	hash := func(s string) *string { return &s }
+	row := upsertedRow{ip: "1.1.1.1", port: 80, transport: "tcp", service: "HTTP", response: "HTTP/1.1 200 OK", hash: "bb"}
+
+	event, ok := row.event()
+	assert.True(t, ok, "inserted rows have no previous hash")
+	assert.Equal(t, ingester.EventServiceDiscovered, event.Type)
+	assert.Equal(t, uint32(80), event.Port)
+	assert.Empty(t, event.PreviousResponseHash)
+	assert.Equal(t, "bb", event.ResponseHash)
+
+	row.previousHash = hash("aa")
+	event, ok = row.event()
+	assert.True(t, ok)
+	assert.Equal(t, ingester.EventServiceChanged, event.Type)
+	assert.Equal(t, "aa", event.PreviousResponseHash)
+	assert.Equal(t, "bb", event.ResponseHash)
+
+	row.previousHash = hash("bb")
+	_, ok = row.event()
+	assert.False(t, ok, "seeing the same response again isn't an event")
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		rejected bool
+	}{
+		{name: "data exception", err: &pgconn.PgError{Code: "22P02"}, rejected: true},
+		{name: "constraint violation", err: fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "23502"}), rejected: true},
+		{name: "other check violation", err: &pgconn.PgError{Code: "23514", TableName: "scan_results"}, rejected: true},
+		{name: "missing history partition", err: &pgconn.PgError{Code: "23514", TableName: "scan_history"}},
+		{name: "serialization failure", err: &pgconn.PgError{Code: "40001"}},
+		{name: "connection lost", err: errors.New("unexpected EOF")},
+		{name: "timeout", err: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyError(tt.err)
+			assert.Equal(t, tt.rejected, errors.Is(err, ingester.ErrRecordRejected))
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
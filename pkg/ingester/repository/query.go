@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/scanning"
+	"github.com/jackc/pgx/v5"
+)
+
+// ScanResult is the latest observation of a single ip/port/transport/service.
+type ScanResult struct {
+	ID        string `json:"id"`
+	Ip        string `json:"ip"`
+	Port      uint32 `json:"port"`
+	Transport string `json:"transport"`
+	Service   string `json:"service"`
+	// Response is sanitized for display, ResponseRaw is exactly what the
+	// scanner saw.
+	Response          string `json:"response"`
+	ResponseRaw       []byte `json:"response_raw"`
+	ResponseValidUTF8 bool   `json:"response_valid_utf8"`
+	// Protocol is the structured part of the response, when the scanner sent
+	// one.
+	Protocol *scanning.ProtocolData `json:"protocol,omitempty"`
+	// ResponseHash is the hex sha256 of ResponseRaw.
+	ResponseHash string    `json:"response_hash"`
+	FirstSeen    time.Time `json:"first_seen"`
+	// LastChanged is when the response was last different to the one before.
+	LastChanged time.Time `json:"last_changed"`
+	LastSeen    time.Time `json:"last_seen"`
+	// SeenCount is how many scans have been newer than the last, changed or not.
+	SeenCount int64 `json:"seen_count"`
+}
+
+// ScanResultQuery filters scan results. Every field is optional, and set fields
+// are combined with AND.
+type ScanResultQuery struct {
+	// Ip matches a single address exactly.
+	Ip string
+	// Network matches every address inside the prefix, eg 1.1.1.0/24.
+	Network   netip.Prefix
+	Port      uint32
+	Transport string
+	Service   string
+	// SeenAfter and SeenBefore bound last_seen, inclusive.
+	SeenAfter  time.Time
+	SeenBefore time.Time
+	// ChangedAfter is a lower bound on last_changed, inclusive.
+	ChangedAfter time.Time
+	// After is the ID of the last result on the previous page. Results are
+	// ordered by ID, which is a v7 uuid so roughly in insertion order.
+	After string
+	// Limit caps the number of results. Zero means no limit.
+	Limit int
+}
+
+// SearchScanResults returns the scan results matching the query, ordered by ID.
+func (r *PostgresRespository) SearchScanResults(ctx context.Context, q ScanResultQuery) ([]ScanResult, error) {
+	sql, args := buildScanResultQuery(q)
+	rows, err := r.conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanScanResult)
+}
+
+// buildScanResultQuery builds the sql for the query. Only the filters that are
+// set end up in the WHERE clause, so the planner can pick the right index
+// instead of dealing with a pile of "$1 IS NULL OR" checks.
+func buildScanResultQuery(q ScanResultQuery) (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if q.Ip != "" {
+		add("ip = $%d", lookupIP(q.Ip))
+	}
+	if q.Network.IsValid() {
+		add("ip <<= $%d::inet", q.Network.Masked().String())
+	}
+	if q.Port != 0 {
+		add("port = $%d", int(q.Port))
+	}
+	if q.Transport != "" {
+		add("transport = $%d", q.Transport)
+	}
+	if q.Service != "" {
+		add("service = $%d", q.Service)
+	}
+	if !q.SeenAfter.IsZero() {
+		add("last_seen >= $%d", q.SeenAfter.UTC())
+	}
+	if !q.SeenBefore.IsZero() {
+		add("last_seen <= $%d", q.SeenBefore.UTC())
+	}
+	if !q.ChangedAfter.IsZero() {
+		add("last_changed >= $%d", q.ChangedAfter.UTC())
+	}
+	if q.After != "" {
+		add("id > $%d::uuid", q.After)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("SELECT id::text, host(ip), port, transport, service, response, response_raw, response_valid_utf8, protocol, " +
+		"encode(response_hash, 'hex'), first_seen, last_changed, last_seen, seen_count FROM scan_results")
+	if len(conds) > 0 {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(strings.Join(conds, " AND "))
+	}
+	sb.WriteString(" ORDER BY id")
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		fmt.Fprintf(&sb, " LIMIT $%d", len(args))
+	}
+	return sb.String(), args
+}
+
+func scanScanResult(row pgx.CollectableRow) (ScanResult, error) {
+	var res ScanResult
+	var port int
+	err := row.Scan(&res.ID, &res.Ip, &port, &res.Transport, &res.Service, &res.Response, &res.ResponseRaw, &res.ResponseValidUTF8, &res.Protocol,
+		&res.ResponseHash, &res.FirstSeen, &res.LastChanged, &res.LastSeen, &res.SeenCount)
+	res.Port = uint32(port)
+	return res, err
+}
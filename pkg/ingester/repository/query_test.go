@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildScanResultQuery(t *testing.T) {
+	after := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		query        ScanResultQuery
+		expectedSQL  string
+		expectedArgs []any
+	}{
+		{
+			name:        "no filters",
+			query:       ScanResultQuery{},
+			expectedSQL: "SELECT id::text, host(ip), port, transport, service, response, response_raw, response_valid_utf8, protocol, encode(response_hash, 'hex'), first_seen, last_changed, last_seen, seen_count FROM scan_results ORDER BY id",
+		},
+		{
+			name:         "ip lookup with a limit",
+			query:        ScanResultQuery{Ip: "1.1.1.1", Limit: 10},
+			expectedSQL:  "SELECT id::text, host(ip), port, transport, service, response, response_raw, response_valid_utf8, protocol, encode(response_hash, 'hex'), first_seen, last_changed, last_seen, seen_count FROM scan_results WHERE ip = $1 ORDER BY id LIMIT $2",
+			expectedArgs: []any{netip.MustParseAddr("1.1.1.1"), 10},
+		},
+		{
+			name: "every filter",
+			query: ScanResultQuery{
+				Network:      netip.MustParsePrefix("1.1.1.7/24"),
+				Port:         443,
+				Transport:    "quic",
+				Service:      "HTTP",
+				SeenAfter:    after,
+				ChangedAfter: after,
+				After:        "0199f0a4-4a5e-7000-8000-000000000000",
+				Limit:        5,
+			},
+			expectedSQL: "SELECT id::text, host(ip), port, transport, service, response, response_raw, response_valid_utf8, protocol, encode(response_hash, 'hex'), first_seen, last_changed, last_seen, seen_count FROM scan_results " +
+				"WHERE ip <<= $1::inet AND port = $2 AND transport = $3 AND service = $4 AND last_seen >= $5 AND last_changed >= $6 AND id > $7::uuid ORDER BY id LIMIT $8",
+			expectedArgs: []any{"1.1.1.0/24", 443, "quic", "HTTP", after, after, "0199f0a4-4a5e-7000-8000-000000000000", 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args := buildScanResultQuery(tt.query)
+			assert.Equal(t, tt.expectedSQL, sql)
+			assert.Equal(t, tt.expectedArgs, args)
+		})
+	}
+}
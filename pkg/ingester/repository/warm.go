@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+)
+
+// StreamLastSeen streams the key and last_seen of every scan result matching
+// the query, newest first, for warming the cache. Rows are handed to f as they
+// come off the wire rather than being collected, so this is fine to run over
+// the whole table.
+func (r *PostgresRespository) StreamLastSeen(ctx context.Context, q ingester.LastSeenQuery, f func(ingester.Scan) error) error {
+	sql, args := buildLastSeenQuery(q)
+	rows, err := r.conn.Query(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scan ingester.Scan
+		var port int
+		var lastSeen time.Time
+		if err := rows.Scan(&scan.Ip, &port, &scan.Transport, &scan.Service, &lastSeen); err != nil {
+			return err
+		}
+		scan.Port = uint32(port)
+		scan.Timestamp = lastSeen.Unix()
+		if err := f(scan); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func buildLastSeenQuery(q ingester.LastSeenQuery) (string, []any) {
+	var sb strings.Builder
+	var args []any
+	sb.WriteString("SELECT host(ip), port, transport, service, last_seen FROM scan_results")
+	if !q.Since.IsZero() {
+		args = append(args, q.Since.UTC())
+		fmt.Fprintf(&sb, " WHERE last_seen >= $%d", len(args))
+	}
+	sb.WriteString(" ORDER BY last_seen DESC")
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		fmt.Fprintf(&sb, " LIMIT $%d", len(args))
+	}
+	return sb.String(), args
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildLastSeenQuery(t *testing.T) {
+	since := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.FixedZone("EST", -5*60*60))
+	tests := []struct {
+		name         string
+		query        ingester.LastSeenQuery
+		expectedSQL  string
+		expectedArgs []any
+	}{
+		{
+			name:        "everything",
+			expectedSQL: "SELECT host(ip), port, transport, service, last_seen FROM scan_results ORDER BY last_seen DESC",
+		},
+		{
+			name:         "window and limit",
+			query:        ingester.LastSeenQuery{Since: since, Limit: 500},
+			expectedSQL:  "SELECT host(ip), port, transport, service, last_seen FROM scan_results WHERE last_seen >= $1 ORDER BY last_seen DESC LIMIT $2",
+			expectedArgs: []any{since.UTC(), 500},
+		},
+		{
+			name:         "limit only",
+			query:        ingester.LastSeenQuery{Limit: 10},
+			expectedSQL:  "SELECT host(ip), port, transport, service, last_seen FROM scan_results ORDER BY last_seen DESC LIMIT $1",
+			expectedArgs: []any{10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args := buildLastSeenQuery(tt.query)
+			assert.Equal(t, tt.expectedSQL, sql)
+			assert.Equal(t, tt.expectedArgs, args)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package ingester
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// SanitizeResponse turns a raw response into text that's safe to display and
+// to store in a postgres TEXT column, along with whether the raw bytes were
+// valid utf-8 to begin with.
+//
+// The charset is detected from a byte order mark if there is one. Otherwise
+// bytes that aren't valid utf-8 are either a few broken sequences in what is
+// mostly utf-8, which get swapped for U+FFFD, or a legacy single byte charset,
+// which is transcoded as windows-1252 (a superset of latin-1). Control
+// characters other than tabs and newlines, NUL included, are replaced with
+// U+FFFD too.
+func SanitizeResponse(raw []byte) (string, bool) {
+	valid := utf8.Valid(raw)
+
+	var text string
+	switch {
+	case bytes.HasPrefix(raw, []byte{0xEF, 0xBB, 0xBF}):
+		text = strings.ToValidUTF8(string(raw[3:]), string(utf8.RuneError))
+	case bytes.HasPrefix(raw, []byte{0xFF, 0xFE}), bytes.HasPrefix(raw, []byte{0xFE, 0xFF}):
+		// the endianness here is only a fallback, the BOM decides.
+		text = transcode(unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), raw)
+	case valid:
+		text = string(raw)
+	case hasMultiByteRune(raw):
+		text = strings.ToValidUTF8(string(raw), string(utf8.RuneError))
+	default:
+		text = transcode(charmap.Windows1252, raw)
+	}
+	return strings.Map(replaceControl, text), valid
+}
+
+// transcode decodes the raw bytes to utf-8, falling back to replacing every
+// invalid sequence if the decoder gives up entirely.
+func transcode(enc encoding.Encoding, raw []byte) string {
+	b, err := enc.NewDecoder().Bytes(raw)
+	if err != nil {
+		return strings.ToValidUTF8(string(raw), string(utf8.RuneError))
+	}
+	return string(b)
+}
+
+// hasMultiByteRune is true if there's at least one valid multi byte utf-8
+// sequence. Legacy charsets almost never produce one by accident, so it's a
+// good sign the invalid bytes are just damage.
+func hasMultiByteRune(b []byte) bool {
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r != utf8.RuneError && size > 1 {
+			return true
+		}
+		b = b[size:]
+	}
+	return false
+}
+
+func replaceControl(r rune) rune {
+	switch {
+	case r == '\t', r == '\n', r == '\r':
+		return r
+	case r < 0x20, r == 0x7F:
+		return utf8.RuneError
+	default:
+		return r
+	}
+}
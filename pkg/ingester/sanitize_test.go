@@ -0,0 +1,32 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           []byte
+		expected      string
+		expectedValid bool
+	}{
+		{name: "plain utf-8", raw: []byte("SSH-2.0-OpenSSH_9.6 ✓"), expected: "SSH-2.0-OpenSSH_9.6 ✓", expectedValid: true},
+		{name: "tabs and newlines are kept", raw: []byte("HTTP/1.1 200 OK\r\n\tServer"), expected: "HTTP/1.1 200 OK\r\n\tServer", expectedValid: true},
+		{name: "nul is replaced", raw: []byte("a\x00b\x7f"), expected: "a�b�", expectedValid: true},
+		{name: "latin-1", raw: []byte("caf\xe9"), expected: "café"},
+		{name: "windows-1252", raw: []byte("\x93quoted\x94"), expected: "“quoted”"},
+		{name: "damaged utf-8", raw: []byte("✓ caf\xe9"), expected: "✓ caf�"},
+		{name: "utf-8 bom", raw: []byte("\xef\xbb\xbfhello"), expected: "hello", expectedValid: true},
+		{name: "utf-16 little endian", raw: []byte("\xff\xfeh\x00i\x00"), expected: "hi"},
+		{name: "utf-16 big endian", raw: []byte("\xfe\xff\x00h\x00i"), expected: "hi"},
+		{name: "empty", raw: nil, expected: "", expectedValid: true},
+	}
+	for _, tt := range tests {
+		text, valid := SanitizeResponse(tt.raw)
+		assert.Equal(t, tt.expected, text, tt.name)
+		assert.Equal(t, tt.expectedValid, valid, tt.name)
+	}
+}
@@ -3,25 +3,47 @@ package ingester
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
 	"time"
 
 	"github.com/censys/scan-takehome/pkg/scanning"
 )
 
+// ErrUnknownDataVersion is returned when a scan arrives with a data version
+// the ingester does not know how to decode.
+var ErrUnknownDataVersion = errors.New("unrecognized Data Version type")
+
 // private struct to take the scanning information and transform the
 // "Data" from an interface to a versioned struct so we can fetch the
 // response string. Could have used a map, but this feels a bit safer
-// in the event a garbled data version comes in
+// in the event a garbled data version comes in. The decoder for each data
+// version is looked up with [RegisterDecoder].
 type Scan struct {
 	scanning.Scan
-	Data     json.RawMessage `json:"data"`
+	Data json.RawMessage `json:"data"`
+	// Response is the sanitized text of the response, for display. See
+	// [SanitizeResponse].
 	Response string
+	// ResponseRaw is the response exactly as it was sent, which may not be
+	// text at all.
+	ResponseRaw []byte
+	// ResponseValidUTF8 is whether ResponseRaw was valid utf-8.
+	ResponseValidUTF8 bool
+	// Protocol is the structured part of the response, only sent by newer
+	// data versions.
+	Protocol *scanning.ProtocolData
 }
 
+// UnmarshalJSON decodes the data with whichever decoder is registered for the
+// data version. Unknown versions fail with [ErrUnknownDataVersion] and disabled
+// ones with [ErrDisabledDataVersion].
 func (s *Scan) UnmarshalJSON(b []byte) error {
 	var container struct {
 		Ip          string          `json:"ip"`
 		Port        uint32          `json:"port"`
+		Transport   string          `json:"transport"`
 		Service     string          `json:"service"`
 		Timestamp   int64           `json:"timestamp"`
 		DataVersion int             `json:"data_version"`
@@ -32,31 +54,78 @@ func (s *Scan) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	s.Ip = container.Ip
+	s.Ip = CanonicalIP(container.Ip)
 	s.Port = container.Port
+	s.Transport = NormalizeTransport(container.Transport)
 	s.Service = container.Service
 	s.DataVersion = container.DataVersion
 	s.Timestamp = container.Timestamp
 
-	switch s.DataVersion {
-	case scanning.V1:
-		var v1Data scanning.V1Data
-		if err := json.Unmarshal(container.Data, &v1Data); err != nil {
-			return err
-		}
-		s.Response = string(v1Data.ResponseBytesUtf8)
-	case scanning.V2:
-		var v2Data scanning.V2Data
-		if err := json.Unmarshal(container.Data, &v2Data); err != nil {
-			return err
-		}
-		s.Response = v2Data.ResponseStr
-	default:
-		return errors.New("unrecognized Data Version type")
+	data, err := decoders.decode(s.DataVersion, container.Data)
+	if err != nil {
+		return err
 	}
+	s.ResponseRaw = data.Response
+	s.Response, s.ResponseValidUTF8 = SanitizeResponse(data.Response)
+	s.Protocol = data.Protocol
 	return nil
 }
 
+// Key is the identity of the scan. Two scans with the same key describe the
+// same row in the data store (the ip_port_transport_service constraint). Ipv6
+// addresses are bracketed, the same as in a url, so the colons don't run into
+// the port.
+func (s *Scan) Key() string {
+	transport := NormalizeTransport(s.Transport)
+	addr, err := ParseIP(s.Ip)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("%s:%d/%s/%s", s.Ip, s.Port, transport, s.Service)
+	case addr.Is6():
+		return fmt.Sprintf("[%s]:%d/%s/%s", addr, s.Port, transport, s.Service)
+	default:
+		return fmt.Sprintf("%s:%d/%s/%s", addr, s.Port, transport, s.Service)
+	}
+}
+
+// NormalizeTransport lower cases the transport, and fills in tcp when there
+// isn't one, which is the case for every V1 and V2 scan.
+func NormalizeTransport(transport string) string {
+	transport = strings.ToLower(strings.TrimSpace(transport))
+	if transport == "" {
+		return scanning.TransportTCP
+	}
+	return transport
+}
+
+// ParseIP parses an ipv4 or ipv6 address. IPv4 mapped ipv6 addresses
+// (::ffff:1.1.1.1) come back as plain ipv4, since they're the same host and
+// postgres would otherwise store them as a different address. Zones only mean
+// something on the scanner's own network, and postgres can't store them, so
+// they're refused.
+func ParseIP(ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if addr.Zone() != "" {
+		return netip.Addr{}, fmt.Errorf("ip %q has a zone", ip)
+	}
+	return addr.Unmap(), nil
+}
+
+// CanonicalIP formats the ip so the different ways of writing the same address
+// all come out the same: ipv4 mapped addresses become plain ipv4, and ipv6 is
+// lower case with the longest run of zeros compressed (RFC 5952). Anything that
+// doesn't parse is left as it is for the [Validator] to turn down.
+func CanonicalIP(ip string) string {
+	addr, err := ParseIP(ip)
+	if err != nil {
+		return ip
+	}
+	return addr.String()
+}
+
 // Time will provide a [time.Time] value instead of the provided unix epoc time
 func (s *Scan) Time() time.Time {
 	return time.Unix(s.Timestamp, 0)
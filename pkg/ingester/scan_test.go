@@ -0,0 +1,72 @@
+package ingester
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/censys/scan-takehome/pkg/scanning"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "1.1.1.1", expected: "1.1.1.1"},
+		{ip: "::ffff:1.1.1.1", expected: "1.1.1.1"},
+		{ip: "::FFFF:0101:0101", expected: "1.1.1.1"},
+		{ip: "2606:4700:4700:0000:0000:0000:0000:1111", expected: "2606:4700:4700::1111"},
+		{ip: "2606:4700:4700:0:0:0:0:1111", expected: "2606:4700:4700::1111"},
+		{ip: "2606:4700:4700::1111", expected: "2606:4700:4700::1111"},
+		{ip: "2606:4700:4700::ABCD", expected: "2606:4700:4700::abcd"},
+		{ip: "2001:db8:0:0:1:0:0:1", expected: "2001:db8::1:0:0:1"},
+		{ip: "not an ip", expected: "not an ip"},
+		{ip: "fe80::1%eth0", expected: "fe80::1%eth0"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, CanonicalIP(tt.ip), tt.ip)
+	}
+}
+
+func TestScanKeyIgnoresIPSpelling(t *testing.T) {
+	decode := func(ip string) Scan {
+		s := newScan(scanning.V2)
+		s.Ip = ip
+		var out Scan
+		assert.NoError(t, json.Unmarshal(ScanToBytes(t, s), &out))
+		return out
+	}
+
+	v6 := decode("2606:4700:4700:0:0:0:0:1111")
+	assert.Equal(t, "2606:4700:4700::1111", v6.Ip, "ips are canonical once decoded")
+	assert.Equal(t, "[2606:4700:4700::1111]:53/tcp/DNS", v6.Key())
+	mapped := decode("::ffff:1.1.1.1")
+	assert.Equal(t, "1.1.1.1:53/tcp/DNS", mapped.Key())
+
+	b := batch{}
+	for _, ip := range []string{"2606:4700:4700::1111", "2606:4700:4700:0000:0000:0000:0000:1111", "2606:4700:4700::1111"} {
+		b.add(&messageRequest{scan: decode(ip)})
+	}
+	b.add(&messageRequest{scan: Scan{Scan: scanning.Scan{Ip: "2606:4700:4700::0:1111", Port: 53, Service: "DNS"}}})
+	assert.Len(t, b, 1, "spellings of the same address are the same row")
+}
+
+func TestScanTransport(t *testing.T) {
+	decode := func(version int, transport string) Scan {
+		s := newScan(version)
+		s.Transport = transport
+		var out Scan
+		assert.NoError(t, json.Unmarshal(ScanToBytes(t, s), &out))
+		return out
+	}
+
+	v1 := decode(scanning.V1, "")
+	v2 := decode(scanning.V2, "")
+	udp := decode(scanning.V3, "UDP")
+	assert.Equal(t, scanning.TransportTCP, v1.Transport, "scans without a transport are tcp")
+	assert.Equal(t, scanning.TransportTCP, v2.Transport, "scans without a transport are tcp")
+	assert.Equal(t, scanning.TransportUDP, udp.Transport)
+	assert.Equal(t, "1.1.1.1:53/udp/DNS", udp.Key())
+	assert.NotEqual(t, v2.Key(), udp.Key(), "the same port over a different transport is a different row")
+}
@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// File writes messages to a local file, one json document per line. Useful
+// when running without a topic, or for local debugging.
+type File[T Message] struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewFile opens (or creates) the file at path for appending
+func NewFile[T Message](path string) (*File[T], error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &File[T]{
+		f:   f,
+		enc: json.NewEncoder(f),
+	}, nil
+}
+
+// Write appends the messages to the file.
+func (s *File[T]) Write(_ context.Context, msgs ...T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		if err := s.enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying file
+func (s *File[T]) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
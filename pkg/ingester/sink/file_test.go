@@ -0,0 +1,102 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quarantine.jsonl")
+	file, err := NewFile[ingester.DeadLetter](path)
+	if err != nil {
+		t.Fatal("failed to create file sink", err)
+	}
+	subject := DeadLetterer{Sink: file}
+
+	letters := []ingester.DeadLetter{
+		{
+			Data:            []byte("{not json"),
+			Reason:          ingester.ReasonMalformedPayload,
+			Error:           "invalid character",
+			MessageID:       "msg-1",
+			DeliveryAttempt: 1,
+			FailedAt:        time.Now().UTC().Truncate(time.Second),
+		},
+		{
+			Data:            []byte(`{"data_version": 99}`),
+			Reason:          ingester.ReasonUnknownDataVersion,
+			Error:           "unrecognized Data Version type: 99",
+			MessageID:       "msg-2",
+			DeliveryAttempt: 3,
+			FailedAt:        time.Now().UTC().Truncate(time.Second),
+		},
+	}
+	for _, letter := range letters {
+		assert.NoError(t, subject.DeadLetter(context.Background(), letter))
+	}
+	assert.NoError(t, subject.Close())
+	assert.Equal(t, letters, readLines[ingester.DeadLetter](t, path))
+}
+
+func TestFileEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	file, err := NewFile[ingester.ChangeEvent](path)
+	if err != nil {
+		t.Fatal("failed to create file sink", err)
+	}
+	subject := EventPublisher{Sink: file}
+
+	events := []ingester.ChangeEvent{
+		{
+			Type:         ingester.EventServiceDiscovered,
+			Ip:           "1.1.1.1",
+			Port:         80,
+			Transport:    "tcp",
+			Service:      "HTTP",
+			ResponseHash: "aa",
+			Response:     "HTTP/1.1 200 OK",
+			ObservedAt:   time.Now().UTC().Truncate(time.Second),
+		},
+		{
+			Type:                 ingester.EventServiceChanged,
+			Ip:                   "2606:4700:4700::1111",
+			Port:                 53,
+			Transport:            "udp",
+			Service:              "DNS",
+			PreviousResponseHash: "aa",
+			ResponseHash:         "bb",
+			Response:             "NOERROR",
+			ObservedAt:           time.Now().UTC().Truncate(time.Second),
+		},
+	}
+	assert.NoError(t, subject.Publish(context.Background(), events[:1]))
+	assert.NoError(t, subject.Publish(context.Background(), events[1:]))
+	assert.NoError(t, subject.Close())
+	assert.Equal(t, events, readLines[ingester.ChangeEvent](t, path))
+}
+
+// readLines decodes every line of the file.
+func readLines[T any](t *testing.T, path string) []T {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("failed to open sink file", err)
+	}
+	defer f.Close()
+
+	var got []T
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var msg T
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &msg))
+		got = append(got, msg)
+	}
+	return got
+}
@@ -0,0 +1,48 @@
+package sink
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// PubSub publishes messages to a pubsub topic, with the body as the message
+// data and the attributes set as pubsub attributes.
+type PubSub[T Message] struct {
+	topic *pubsub.Topic
+}
+
+// NewPubSub creates a sink that will publish to the provided topic
+func NewPubSub[T Message](topic *pubsub.Topic) *PubSub[T] {
+	return &PubSub[T]{
+		topic: topic,
+	}
+}
+
+// Write publishes every message and waits for the server to accept all of
+// them. The client batches them up, so they're all sent before waiting.
+func (s *PubSub[T]) Write(ctx context.Context, msgs ...T) error {
+	results := make([]*pubsub.PublishResult, 0, len(msgs))
+	for _, msg := range msgs {
+		data, err := msg.Body()
+		if err != nil {
+			return err
+		}
+		results = append(results, s.topic.Publish(ctx, &pubsub.Message{
+			Data:       data,
+			Attributes: msg.Attributes(),
+		}))
+	}
+	for _, res := range results {
+		if _, err := res.Get(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close sends anything the topic still has batched up.
+func (s *PubSub[T]) Close() error {
+	s.topic.Stop()
+	return nil
+}
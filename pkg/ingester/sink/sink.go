@@ -0,0 +1,46 @@
+// Package sink writes messages somewhere they can be picked up later: a pubsub
+// topic, or a local file. It's used for dead letters, quarantined scans and
+// change events, which only differ in what they write.
+package sink
+
+import (
+	"context"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+)
+
+// Message is anything a sink can write. Body is what's published, with the
+// attributes alongside it. The file sink writes the whole message as json
+// instead.
+type Message interface {
+	Body() ([]byte, error)
+	Attributes() map[string]string
+}
+
+// Sink writes messages, only returning once every one of them has been
+// accepted.
+type Sink[T Message] interface {
+	Write(ctx context.Context, msgs ...T) error
+	// Close flushes and releases the sink.
+	Close() error
+}
+
+// DeadLetterer sends dead letters to the sink.
+type DeadLetterer struct {
+	Sink[ingester.DeadLetter]
+}
+
+// DeadLetter writes the letter to the sink.
+func (d DeadLetterer) DeadLetter(ctx context.Context, letter ingester.DeadLetter) error {
+	return d.Write(ctx, letter)
+}
+
+// EventPublisher sends change events to the sink.
+type EventPublisher struct {
+	Sink[ingester.ChangeEvent]
+}
+
+// Publish writes the events to the sink.
+func (p EventPublisher) Publish(ctx context.Context, events []ingester.ChangeEvent) error {
+	return p.Write(ctx, events...)
+}
@@ -0,0 +1,26 @@
+package ingester
+
+import "context"
+
+// Message is a single payload handed to the ingester by a [Source], along with
+// the handle used to ack or nack it once we know what happened to the scan.
+type Message struct {
+	Data   []byte
+	Info   MessageInfo
+	Handle Handle
+}
+
+// MessageHandler processes a single message from a [Source]. The handler is
+// responsible for calling Ack() or Nack() on the message handle.
+type MessageHandler func(ctx context.Context, msg Message)
+
+// Source is anything that can deliver scan payloads to the [Ingester].
+// Receive should block until the context is done, and may call the handler
+// concurrently. The handler blocks until the scan has been saved (or not), so
+// a source should not wait on one message before delivering the next.
+type Source interface {
+	Receive(ctx context.Context, f MessageHandler) error
+	// Close releases anything the source is holding on to. It is called after
+	// Receive has returned.
+	Close(ctx context.Context) error
+}
@@ -0,0 +1,390 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// KafkaConfig holds the settings for a [KafkaSource]
+type KafkaConfig struct {
+	Brokers []string
+	Topic   string
+	GroupID string
+	// MaxInFlight is the number of messages that can be fetched but not yet
+	// acked at any one time.
+	MaxInFlight int
+	// CommitInterval is how often offsets are flushed to kafka. Zero will
+	// commit synchronously on every ack.
+	CommitInterval time.Duration
+	// RetryBackoff is how long to wait before redelivering a nacked message.
+	RetryBackoff time.Duration
+	// MaxDeliveryAttempts is how many times a message is delivered before the
+	// source gives up on it. Zero retries forever.
+	MaxDeliveryAttempts int
+	// DeadLetter is where messages go when they run out of delivery attempts.
+	// Without one they're logged and skipped.
+	DeadLetter ingester.DeadLetterer
+}
+
+// kafkaReader is the part of [kafka.Reader] we use, pulled out so the source
+// can be tested without a broker.
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaSource delivers messages from a kafka topic using a consumer group.
+//
+// Kafka only tracks a single offset per partition, while the upserters ack
+// messages in whatever order their batches flush. To avoid committing past a
+// message that hasn't been saved yet, the source keeps track of every fetched
+// offset and only commits up to the last one that has every message before it
+// acked. Nacked messages are redelivered to the handler after a backoff, since
+// kafka has no concept of a nack, until they run out of delivery attempts.
+//
+// Commits are made by a single goroutine, outside of the lock, so a slow
+// commit doesn't hold up acks or fetching. Acks just record the offset to
+// commit, and whatever has piled up is committed in one go.
+type KafkaSource struct {
+	reader kafkaReader
+	cfg    KafkaConfig
+	l      *zap.Logger
+
+	mu         sync.Mutex
+	partitions map[int]*partitionOffsets
+	// pending is the next offset to commit for each partition.
+	pending     map[int]kafka.Message
+	commitReady chan struct{}
+	// commitMu keeps the commit loop and Close from committing at the same
+	// time, which could commit a partition out of order.
+	commitMu sync.Mutex
+}
+
+// NewKafkaSource creates a consumer group reader for the configured topic
+func NewKafkaSource(l *zap.Logger, cfg KafkaConfig) *KafkaSource {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:        cfg.Brokers,
+		Topic:          cfg.Topic,
+		GroupID:        cfg.GroupID,
+		CommitInterval: cfg.CommitInterval,
+	})
+	return newKafkaSource(l, reader, cfg)
+}
+
+func newKafkaSource(l *zap.Logger, reader kafkaReader, cfg KafkaConfig) *KafkaSource {
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = 1
+	}
+	return &KafkaSource{
+		reader:      reader,
+		cfg:         cfg,
+		l:           l,
+		partitions:  map[int]*partitionOffsets{},
+		pending:     map[int]kafka.Message{},
+		commitReady: make(chan struct{}, 1),
+	}
+}
+
+// Receive fetches messages from kafka and hands each to the handler in its own
+// goroutine until the context is done. No more than MaxInFlight messages will
+// be waiting on an ack at once.
+func (s *KafkaSource) Receive(ctx context.Context, f ingester.MessageHandler) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	go s.commitLoop(ctx)
+
+	inFlight := make(chan struct{}, s.cfg.MaxInFlight)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case inFlight <- struct{}{}:
+		}
+
+		m, err := s.reader.FetchMessage(ctx)
+		if err != nil {
+			<-inFlight
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s.fetched(m)
+
+		handle := &kafkaMessage{
+			src:      s,
+			msg:      m,
+			attempt:  1,
+			release:  func() { <-inFlight },
+			dispatch: func(h *kafkaMessage, delay time.Duration) { s.dispatch(ctx, &wg, f, h, delay) },
+		}
+		s.dispatch(ctx, &wg, f, handle, 0)
+	}
+}
+
+// Close commits anything acked since the last commit and closes the kafka
+// reader, flushing any commits it has queued up.
+func (s *KafkaSource) Close(_ context.Context) error {
+	s.commit()
+	return s.reader.Close()
+}
+
+// dispatch hands the message to the handler in its own goroutine, after
+// waiting for delay. If the context is done before then, the message is
+// dropped without being committed and kafka will deliver it again next time.
+func (s *KafkaSource) dispatch(ctx context.Context, wg *sync.WaitGroup, f ingester.MessageHandler, h *kafkaMessage, delay time.Duration) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			defer t.Stop()
+			select {
+			case <-ctx.Done():
+				h.release()
+				return
+			case <-t.C:
+			}
+		}
+		f(ctx, ingester.Message{
+			Data: h.msg.Value,
+			Info: ingester.MessageInfo{
+				ID:              messageID(h.msg),
+				DeliveryAttempt: h.attempt,
+				Attributes:      headers(h.msg.Headers),
+			},
+			Handle: h,
+		})
+	}()
+}
+
+// fetched starts tracking the offset of a freshly fetched message.
+func (s *KafkaSource) fetched(m kafka.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.partitions[m.Partition]
+	if !ok {
+		p = newPartitionOffsets()
+		s.partitions[m.Partition] = p
+	}
+	p.fetched(m.Offset)
+}
+
+// ack marks the message as done and queues up the furthest offset the
+// partition can now safely commit.
+func (s *KafkaSource) ack(m kafka.Message) {
+	s.mu.Lock()
+	p, ok := s.partitions[m.Partition]
+	var offset int64
+	if ok {
+		offset, ok = p.ack(m.Offset)
+	}
+	if ok {
+		s.pending[m.Partition] = kafka.Message{
+			Topic:     m.Topic,
+			Partition: m.Partition,
+			Offset:    offset,
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		select {
+		case s.commitReady <- struct{}{}:
+		default:
+			// a commit is already on the way and will pick this up.
+		}
+	}
+}
+
+// commitLoop commits acked offsets until the context is done. Anything acked
+// after that is committed by Close.
+func (s *KafkaSource) commitLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.commitReady:
+			s.commit()
+		}
+	}
+}
+
+// commit commits the pending offset for every partition.
+func (s *KafkaSource) commit() {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = map[int]kafka.Message{}
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*10)
+	defer fn()
+	msgs := slices.Collect(maps.Values(pending))
+	if err := s.reader.CommitMessages(ctx, msgs...); err != nil {
+		// put the offsets back for the next commit, unless an ack has
+		// already moved the partition on. Either way nothing is lost, at
+		// worst the messages are delivered again.
+		s.l.Error("failed to commit kafka offsets", zap.Error(err), zap.Int("partitions", len(msgs)))
+		s.mu.Lock()
+		for partition, m := range pending {
+			if _, ok := s.pending[partition]; !ok {
+				s.pending[partition] = m
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// giveUp dead letters a message that has run out of delivery attempts. It
+// returns false if the dead letter sink failed, in which case the message
+// should be retried.
+func (s *KafkaSource) giveUp(m *kafkaMessage) bool {
+	id := messageID(m.msg)
+	if s.cfg.DeadLetter == nil {
+		s.l.Error("kafka message ran out of delivery attempts, skipping it",
+			zap.String("messageID", id),
+			zap.Int("deliveryAttempt", m.attempt),
+		)
+		return true
+	}
+
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*10)
+	defer fn()
+	err := s.cfg.DeadLetter.DeadLetter(ctx, ingester.DeadLetter{
+		Data:            m.msg.Value,
+		Reason:          ingester.ReasonMaxDeliveryAttempts,
+		Error:           fmt.Sprintf("gave up after %d delivery attempts", m.attempt),
+		MessageID:       id,
+		DeliveryAttempt: m.attempt,
+		FailedAt:        time.Now(),
+	})
+	if err != nil {
+		s.l.Error("failed to dead letter kafka message", zap.Error(err), zap.String("messageID", id))
+		return false
+	}
+	s.l.Warn("kafka message ran out of delivery attempts, dead lettered",
+		zap.String("messageID", id),
+		zap.Int("deliveryAttempt", m.attempt),
+	)
+	return true
+}
+
+// kafkaMessage is the ack/nack handle for a message fetched from kafka
+type kafkaMessage struct {
+	src      *KafkaSource
+	msg      kafka.Message
+	attempt  int
+	release  func()
+	dispatch func(*kafkaMessage, time.Duration)
+	once     sync.Once
+}
+
+// Ack marks the message as processed so its offset can be committed.
+func (m *kafkaMessage) Ack() {
+	m.once.Do(func() {
+		m.src.ack(m.msg)
+		m.release()
+	})
+}
+
+// Nack redelivers the message to the handler after the retry backoff. The
+// offset stays uncommitted until the message is eventually acked, or runs out
+// of delivery attempts and is dead lettered.
+func (m *kafkaMessage) Nack() {
+	m.once.Do(func() {
+		maxAttempts := m.src.cfg.MaxDeliveryAttempts
+		if maxAttempts > 0 && m.attempt >= maxAttempts && m.src.giveUp(m) {
+			m.src.ack(m.msg)
+			m.release()
+			return
+		}
+		retry := &kafkaMessage{
+			src:      m.src,
+			msg:      m.msg,
+			attempt:  m.attempt + 1,
+			release:  m.release,
+			dispatch: m.dispatch,
+		}
+		m.dispatch(retry, m.src.cfg.RetryBackoff)
+	})
+}
+
+// partitionOffsets tracks fetched offsets for a single partition, in the order
+// they were fetched, so we know the highest offset that is safe to commit.
+// Kafka offsets aren't guaranteed to be contiguous (compaction, transactions),
+// so we can't just count.
+type partitionOffsets struct {
+	offsets []int64
+	acked   map[int64]bool
+}
+
+func newPartitionOffsets() *partitionOffsets {
+	return &partitionOffsets{
+		acked: map[int64]bool{},
+	}
+}
+
+// fetched records a new offset. If the offset goes backwards the partition
+// was rewound (usually a rebalance), and anything we were tracking will be
+// delivered again, so start over.
+func (p *partitionOffsets) fetched(offset int64) {
+	if n := len(p.offsets); n > 0 && offset <= p.offsets[n-1] {
+		p.offsets = p.offsets[:0]
+		clear(p.acked)
+	}
+	p.offsets = append(p.offsets, offset)
+	p.acked[offset] = false
+}
+
+// ack marks the offset as acked and returns the highest offset that can now
+// be committed, if any.
+func (p *partitionOffsets) ack(offset int64) (int64, bool) {
+	if _, ok := p.acked[offset]; !ok {
+		// not an offset we're tracking anymore
+		return 0, false
+	}
+	p.acked[offset] = true
+
+	var commit int64
+	var ok bool
+	for len(p.offsets) > 0 && p.acked[p.offsets[0]] {
+		commit = p.offsets[0]
+		ok = true
+		delete(p.acked, commit)
+		p.offsets = p.offsets[1:]
+	}
+	return commit, ok
+}
+
+// messageID identifies the message by where it is in the topic.
+func messageID(m kafka.Message) string {
+	return fmt.Sprintf("%s/%d/%d", m.Topic, m.Partition, m.Offset)
+}
+
+// headers flattens the kafka headers into message attributes. If a key is
+// repeated the last one wins.
+func headers(hs []kafka.Header) map[string]string {
+	if len(hs) == 0 {
+		return nil
+	}
+	attrs := make(map[string]string, len(hs))
+	for _, h := range hs {
+		attrs[h.Key] = string(h.Value)
+	}
+	return attrs
+}
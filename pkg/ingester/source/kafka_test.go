@@ -0,0 +1,307 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPartitionOffsets(t *testing.T) {
+	tests := []struct {
+		name     string
+		fetched  []int64
+		acks     []int64
+		expected []int64 // commits after each ack, -1 for no commit
+	}{
+		{
+			name:     "in order acks commit every time",
+			fetched:  []int64{1, 2, 3},
+			acks:     []int64{1, 2, 3},
+			expected: []int64{1, 2, 3},
+		},
+		{
+			name:     "out of order acks wait for the gap to fill",
+			fetched:  []int64{1, 2, 3, 4},
+			acks:     []int64{3, 2, 4, 1},
+			expected: []int64{-1, -1, -1, 4},
+		},
+		{
+			name:     "non contiguous offsets",
+			fetched:  []int64{10, 15, 16},
+			acks:     []int64{15, 10, 16},
+			expected: []int64{-1, 15, 16},
+		},
+		{
+			name:     "acks for offsets we aren't tracking are ignored",
+			fetched:  []int64{5, 6},
+			acks:     []int64{1, 5, 5, 6},
+			expected: []int64{-1, 5, -1, 6},
+		},
+		{
+			name:     "rewound partition starts over",
+			fetched:  []int64{5, 6, 7, 5, 6},
+			acks:     []int64{7, 5, 6},
+			expected: []int64{-1, 5, 6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject := newPartitionOffsets()
+			for _, offset := range tt.fetched {
+				subject.fetched(offset)
+			}
+			for i, offset := range tt.acks {
+				commit, ok := subject.ack(offset)
+				if tt.expected[i] == -1 {
+					assert.False(t, ok, "ack %d should not commit", offset)
+				} else {
+					assert.True(t, ok, "ack %d should commit", offset)
+					assert.Equal(t, tt.expected[i], commit)
+				}
+			}
+		})
+	}
+}
+
+func TestKafkaSourceCommitsInOrder(t *testing.T) {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	reader := newFakeReader(
+		kafka.Message{Topic: "scans", Partition: 0, Offset: 1, Value: []byte("a")},
+		kafka.Message{Topic: "scans", Partition: 0, Offset: 2, Value: []byte("b")},
+		kafka.Message{Topic: "scans", Partition: 1, Offset: 7, Value: []byte("c")},
+		kafka.Message{Topic: "scans", Partition: 0, Offset: 3, Value: []byte("d")},
+	)
+	subject := newKafkaSource(zaptest.NewLogger(t), reader, KafkaConfig{MaxInFlight: 10})
+
+	received := make(chan ingester.Message, 4)
+	go subject.Receive(ctx, func(_ context.Context, msg ingester.Message) {
+		received <- msg
+	})
+
+	msgs := map[string]ingester.Message{}
+	for range 4 {
+		msg := <-received
+		msgs[string(msg.Data)] = msg
+	}
+	assert.Equal(t, "scans/0/2", msgs["b"].Info.ID)
+
+	// ack the later messages on partition 0 first, nothing there can be
+	// committed until "a" is acked.
+	msgs["d"].Handle.Ack()
+	msgs["b"].Handle.Ack()
+	msgs["c"].Handle.Ack()
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]kafka.Message{{Topic: "scans", Partition: 1, Offset: 7}}, reader.committed())
+	}, time.Second, time.Millisecond*10)
+
+	msgs["a"].Handle.Ack()
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]kafka.Message{
+			{Topic: "scans", Partition: 1, Offset: 7},
+			{Topic: "scans", Partition: 0, Offset: 3},
+		}, reader.committed())
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestKafkaSourceSlowCommitsDontBlockFetching(t *testing.T) {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	reader := newFakeReader(
+		kafka.Message{Topic: "scans", Partition: 0, Offset: 1, Value: []byte("a")},
+		kafka.Message{Topic: "scans", Partition: 0, Offset: 2, Value: []byte("b")},
+		kafka.Message{Topic: "scans", Partition: 0, Offset: 3, Value: []byte("c")},
+	)
+	reader.commitGate = make(chan struct{})
+	subject := newKafkaSource(zaptest.NewLogger(t), reader, KafkaConfig{MaxInFlight: 1})
+
+	received := make(chan ingester.Message, 3)
+	go subject.Receive(ctx, func(_ context.Context, msg ingester.Message) {
+		received <- msg
+	})
+
+	// the first commit hangs, but acking and fetching carry on.
+	(<-received).Handle.Ack()
+	(<-received).Handle.Ack()
+	third := <-received
+	assert.Equal(t, []byte("c"), third.Data)
+	third.Handle.Ack()
+
+	close(reader.commitGate)
+	assert.NoError(t, subject.Close(ctx))
+	committed := reader.committed()
+	if assert.NotEmpty(t, committed) {
+		assert.Equal(t, int64(3), committed[len(committed)-1].Offset, "everything acked is committed by the time Close returns")
+	}
+}
+
+func TestKafkaSourceRedeliversNacks(t *testing.T) {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	reader := newFakeReader(
+		kafka.Message{Topic: "scans", Partition: 0, Offset: 1, Value: []byte("a")},
+	)
+	subject := newKafkaSource(zaptest.NewLogger(t), reader, KafkaConfig{
+		MaxInFlight:  1,
+		RetryBackoff: time.Millisecond * 10,
+	})
+
+	received := make(chan ingester.Message, 2)
+	go subject.Receive(ctx, func(_ context.Context, msg ingester.Message) {
+		received <- msg
+	})
+
+	first := <-received
+	assert.Equal(t, 1, first.Info.DeliveryAttempt)
+	first.Handle.Nack()
+	assert.Empty(t, reader.committed())
+
+	second := <-received
+	assert.Equal(t, first.Info.ID, second.Info.ID)
+	assert.Equal(t, 2, second.Info.DeliveryAttempt)
+	second.Handle.Ack()
+	assert.NoError(t, subject.Close(ctx))
+	assert.Equal(t, []kafka.Message{{Topic: "scans", Partition: 0, Offset: 1}}, reader.committed())
+}
+
+func TestKafkaSourceDeadLettersAfterMaxAttempts(t *testing.T) {
+	tests := []struct {
+		name            string
+		dlqErr          error
+		expectedCommits int
+		expectedRetry   bool
+	}{
+		{name: "dead lettered and committed", expectedCommits: 1},
+		{name: "failed dead letter is retried", dlqErr: errors.New("test-error"), expectedRetry: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+			defer fn()
+			reader := newFakeReader(
+				kafka.Message{Topic: "scans", Partition: 0, Offset: 1, Value: []byte("a")},
+			)
+			dlq := &fakeDeadLetterer{err: tt.dlqErr}
+			subject := newKafkaSource(zaptest.NewLogger(t), reader, KafkaConfig{
+				MaxInFlight:         1,
+				RetryBackoff:        time.Millisecond * 10,
+				MaxDeliveryAttempts: 2,
+				DeadLetter:          dlq,
+			})
+
+			received := make(chan ingester.Message, 3)
+			go subject.Receive(ctx, func(_ context.Context, msg ingester.Message) {
+				received <- msg
+			})
+
+			(<-received).Handle.Nack()
+			second := <-received
+			assert.Equal(t, 2, second.Info.DeliveryAttempt)
+			second.Handle.Nack()
+
+			if assert.Len(t, dlq.letters, 1) {
+				letter := dlq.letters[0]
+				assert.Equal(t, []byte("a"), letter.Data)
+				assert.Equal(t, ingester.ReasonMaxDeliveryAttempts, letter.Reason)
+				assert.Equal(t, "scans/0/1", letter.MessageID)
+				assert.Equal(t, 2, letter.DeliveryAttempt)
+			}
+			if tt.expectedRetry {
+				third := <-received
+				assert.Equal(t, 3, third.Info.DeliveryAttempt)
+			}
+			assert.NoError(t, subject.Close(ctx))
+			assert.Len(t, reader.committed(), tt.expectedCommits)
+		})
+	}
+}
+
+func TestKafkaSourceLimitsInFlight(t *testing.T) {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	reader := newFakeReader(
+		kafka.Message{Topic: "scans", Partition: 0, Offset: 1, Value: []byte("a")},
+		kafka.Message{Topic: "scans", Partition: 0, Offset: 2, Value: []byte("b")},
+	)
+	subject := newKafkaSource(zaptest.NewLogger(t), reader, KafkaConfig{MaxInFlight: 1})
+
+	received := make(chan ingester.Message, 2)
+	go subject.Receive(ctx, func(_ context.Context, msg ingester.Message) {
+		received <- msg
+	})
+
+	first := <-received
+	select {
+	case <-received:
+		t.Fatal("second message should wait for the first to be acked")
+	case <-time.After(time.Millisecond * 100):
+	}
+	first.Handle.Ack()
+	second := <-received
+	assert.Equal(t, []byte("b"), second.Data)
+}
+
+// fakeReader hands out the provided messages and then blocks until the
+// context is done, like a reader caught up with its partitions.
+type fakeReader struct {
+	msgs chan kafka.Message
+	// commitGate holds up commits until it's closed, when set.
+	commitGate chan struct{}
+
+	mu      sync.Mutex
+	commits []kafka.Message
+}
+
+func newFakeReader(msgs ...kafka.Message) *fakeReader {
+	r := &fakeReader{msgs: make(chan kafka.Message, len(msgs))}
+	for _, m := range msgs {
+		r.msgs <- m
+	}
+	return r
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case m := <-r.msgs:
+		return m, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	if r.commitGate != nil {
+		<-r.commitGate
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commits = append(r.commits, msgs...)
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+func (r *fakeReader) committed() []kafka.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]kafka.Message{}, r.commits...)
+}
+
+type fakeDeadLetterer struct {
+	err     error
+	letters []ingester.DeadLetter
+}
+
+func (d *fakeDeadLetterer) DeadLetter(_ context.Context, letter ingester.DeadLetter) error {
+	d.letters = append(d.letters, letter)
+	return d.err
+}
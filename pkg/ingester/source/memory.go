@@ -0,0 +1,132 @@
+package source
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+)
+
+// MemorySource is an in memory [ingester.Source], mostly for tests. Messages
+// are published with [MemorySource.Publish] and the returned handle can be used
+// to see whether the ingester acked or nacked them. Nacked messages are not
+// redelivered.
+type MemorySource struct {
+	msgs      chan ingester.Message
+	nextID    atomic.Int64
+	closeOnce sync.Once
+}
+
+// NewMemorySource creates a source that can hold buffer unreceived messages
+// before Publish blocks.
+func NewMemorySource(buffer int) *MemorySource {
+	return &MemorySource{
+		msgs: make(chan ingester.Message, buffer),
+	}
+}
+
+// Publish queues the data for delivery and returns the handle that will be
+// acked or nacked.
+func (s *MemorySource) Publish(ctx context.Context, data []byte) (*MemoryMessage, error) {
+	handle := &MemoryMessage{done: make(chan struct{})}
+	msg := ingester.Message{
+		Data: data,
+		Info: ingester.MessageInfo{
+			ID:              strconv.FormatInt(s.nextID.Add(1), 10),
+			DeliveryAttempt: 1,
+		},
+		Handle: handle,
+	}
+
+	select {
+	case s.msgs <- msg:
+		return handle, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Receive delivers published messages to the handler, each in its own
+// goroutine, until the context is done or the source is closed and drained. It waits for
+// any handlers still running before returning.
+func (s *MemorySource) Receive(ctx context.Context, f ingester.MessageHandler) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-s.msgs:
+			if !ok {
+				return nil
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f(ctx, msg)
+			}()
+		}
+	}
+}
+
+// Close lets Receive return once it has drained any queued messages. Publish
+// must not be called after the source is closed.
+func (s *MemorySource) Close(_ context.Context) error {
+	s.closeOnce.Do(func() {
+		close(s.msgs)
+	})
+	return nil
+}
+
+// MemoryMessage is the ack/nack handle for a message published to a
+// [MemorySource].
+type MemoryMessage struct {
+	mu     sync.Mutex
+	acked  bool
+	nacked bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Ack marks the message as successfully processed.
+func (m *MemoryMessage) Ack() {
+	m.settle(true)
+}
+
+// Nack marks the message as failed.
+func (m *MemoryMessage) Nack() {
+	m.settle(false)
+}
+
+// Done is closed once the message has been acked or nacked.
+func (m *MemoryMessage) Done() <-chan struct{} {
+	return m.done
+}
+
+// Acked reports whether the message was acked.
+func (m *MemoryMessage) Acked() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.acked
+}
+
+// Nacked reports whether the message was nacked.
+func (m *MemoryMessage) Nacked() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.nacked
+}
+
+// settle records the first ack or nack. Like pubsub, anything after that is
+// ignored.
+func (m *MemoryMessage) settle(ack bool) {
+	m.once.Do(func() {
+		m.mu.Lock()
+		m.acked = ack
+		m.nacked = !ack
+		m.mu.Unlock()
+		close(m.done)
+	})
+}
@@ -0,0 +1,105 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/ingester"
+	"github.com/censys/scan-takehome/pkg/scanning"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+// Runs the ingester and an upserter end to end over the memory source, which
+// covers [ingester.Ingester.Start] without needing a pubsub emulator.
+func TestMemorySourceEndToEnd(t *testing.T) {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	l := zaptest.NewLogger(t)
+
+	src := NewMemorySource(10)
+	repo := &mockRepo{}
+	ingest := ingester.NewIngester(l, src, ingester.WithMessageAckTimeout(time.Second*2))
+	up := ingester.NewUpserter(l, ingest.SendChan, repo, time.Millisecond*100, 10)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go up.Start(ctx, &wg)
+	go ingest.Start(ctx)
+
+	handles := []*MemoryMessage{}
+	for i := range 3 {
+		handle, err := src.Publish(ctx, scanBytes(t, uint32(80+i)))
+		assert.NoError(t, err)
+		handles = append(handles, handle)
+	}
+
+	for _, handle := range handles {
+		select {
+		case <-handle.Done():
+			assert.True(t, handle.Acked())
+			assert.False(t, handle.Nacked())
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for message to be acked")
+		}
+	}
+	assert.Len(t, repo.saved(), 3)
+
+	fn()
+	wg.Wait()
+}
+
+func TestMemorySourceReceiveReturnsOnClose(t *testing.T) {
+	src := NewMemorySource(1)
+	_, err := src.Publish(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, src.Close(context.Background()))
+
+	var received []ingester.Message
+	err = src.Receive(context.Background(), func(_ context.Context, msg ingester.Message) {
+		received = append(received, msg)
+		msg.Handle.Nack()
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, []byte("hello"), received[0].Data)
+		assert.Equal(t, "1", received[0].Info.ID)
+		assert.True(t, received[0].Handle.(*MemoryMessage).Nacked())
+	}
+}
+
+func scanBytes(t *testing.T, port uint32) []byte {
+	encoded, err := json.Marshal(scanning.Scan{
+		Ip:          "1.1.1.1",
+		Port:        port,
+		Service:     "HTTP",
+		Timestamp:   time.Now().Unix(),
+		DataVersion: scanning.V2,
+		Data:        &scanning.V2Data{ResponseStr: "test-response"},
+	})
+	if err != nil {
+		t.Fatal("failed to marshal scan to json bytes", err)
+	}
+	return encoded
+}
+
+type mockRepo struct {
+	mu  sync.Mutex
+	res []ingester.Scan
+}
+
+func (m *mockRepo) UpsertMany(_ context.Context, scans []ingester.Scan) (ingester.UpsertStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.res = append(m.res, scans...)
+	return ingester.UpsertStats{New: len(scans)}, nil
+}
+
+func (m *mockRepo) saved() []ingester.Scan {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.res
+}
@@ -0,0 +1,60 @@
+package source
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/censys/scan-takehome/pkg/ingester"
+)
+
+// PubSubSource delivers messages from a google pubsub subscription.
+type PubSubSource struct {
+	sub           *pubsub.Subscription
+	deleteOnClose bool
+}
+
+// PubSubOption provides additional configuration for the [PubSubSource]
+type PubSubOption func(*PubSubSource)
+
+// WithDeleteOnClose will delete the subscription when the source is closed.
+// Only useful for subscriptions that are created per run.
+func WithDeleteOnClose() PubSubOption {
+	return func(s *PubSubSource) {
+		s.deleteOnClose = true
+	}
+}
+
+// NewPubSubSource creates a source for the provided subscription. Concurrency
+// is controlled with the subscription's ReceiveSettings.
+func NewPubSubSource(sub *pubsub.Subscription, opts ...PubSubOption) *PubSubSource {
+	s := &PubSubSource{
+		sub: sub,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Receive will listen on the subscription until the context is done.
+func (s *PubSubSource) Receive(ctx context.Context, f ingester.MessageHandler) error {
+	return s.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		info := ingester.MessageInfo{ID: m.ID, Attributes: m.Attributes}
+		if m.DeliveryAttempt != nil {
+			info.DeliveryAttempt = *m.DeliveryAttempt
+		}
+		f(ctx, ingester.Message{
+			Data:   m.Data,
+			Info:   info,
+			Handle: m,
+		})
+	})
+}
+
+// Close deletes the subscription if the source was configured to.
+func (s *PubSubSource) Close(ctx context.Context) error {
+	if !s.deleteOnClose {
+		return nil
+	}
+	return s.sub.Delete(ctx)
+}
@@ -0,0 +1,112 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/zap"
+)
+
+// SubscriptionConfig describes the pubsub subscription the ingester listens
+// on. Zero values are left to pubsub's defaults.
+type SubscriptionConfig struct {
+	ID    string
+	Topic *pubsub.Topic
+	// AckDeadline is how long pubsub waits for an ack before redelivering.
+	AckDeadline time.Duration
+	// RetentionDuration is how long unacked messages are kept around.
+	RetentionDuration time.Duration
+	// DeadLetterTopic is the topic pubsub forwards messages to after
+	// MaxDeliveryAttempts. Leave nil to disable the dead letter policy.
+	DeadLetterTopic     *pubsub.Topic
+	MaxDeliveryAttempts int
+	// Filter can only be set when the subscription is created.
+	Filter string
+}
+
+// EnsureSubscription returns the subscription with the configured ID, creating
+// it if it doesn't exist yet. Using a stable subscription means messages
+// published while the ingester is down are waiting for it when it comes back,
+// and replicas share the work instead of each getting every message.
+//
+// If the subscription already exists, the ack deadline, retention and dead
+// letter policy are updated to match the config. Filters are immutable in
+// pubsub, so a mismatched filter is only logged.
+func EnsureSubscription(ctx context.Context, l *zap.Logger, client *pubsub.Client, cfg SubscriptionConfig) (*pubsub.Subscription, error) {
+	sub := client.Subscription(cfg.ID)
+	exists, err := sub.Exists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for subscription %s: %w", cfg.ID, err)
+	}
+
+	if !exists {
+		l.Info("creating pubsub subscription", zap.String("subscription", cfg.ID))
+		sub, err = client.CreateSubscription(ctx, cfg.ID, pubsub.SubscriptionConfig{
+			Topic:             cfg.Topic,
+			AckDeadline:       cfg.AckDeadline,
+			RetentionDuration: cfg.RetentionDuration,
+			DeadLetterPolicy:  cfg.deadLetterPolicy(),
+			Filter:            cfg.Filter,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create subscription %s: %w", cfg.ID, err)
+		}
+		return sub, nil
+	}
+
+	existing, err := sub.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config for subscription %s: %w", cfg.ID, err)
+	}
+	if existing.Filter != cfg.Filter {
+		l.Warn("subscription filter differs from config and can't be changed, recreate the subscription to apply it",
+			zap.String("subscription", cfg.ID),
+			zap.String("existing", existing.Filter),
+			zap.String("configured", cfg.Filter),
+		)
+	}
+
+	update, changed := cfg.updateFrom(existing)
+	if !changed {
+		return sub, nil
+	}
+	l.Info("updating pubsub subscription to match config", zap.String("subscription", cfg.ID))
+	if _, err := sub.Update(ctx, update); err != nil {
+		return nil, fmt.Errorf("failed to update subscription %s: %w", cfg.ID, err)
+	}
+	return sub, nil
+}
+
+func (cfg SubscriptionConfig) deadLetterPolicy() *pubsub.DeadLetterPolicy {
+	if cfg.DeadLetterTopic == nil {
+		return nil
+	}
+	return &pubsub.DeadLetterPolicy{
+		DeadLetterTopic:     cfg.DeadLetterTopic.String(),
+		MaxDeliveryAttempts: cfg.MaxDeliveryAttempts,
+	}
+}
+
+// updateFrom works out which of the mutable settings differ from the existing
+// subscription.
+func (cfg SubscriptionConfig) updateFrom(existing pubsub.SubscriptionConfig) (pubsub.SubscriptionConfigToUpdate, bool) {
+	var update pubsub.SubscriptionConfigToUpdate
+	changed := false
+	if cfg.AckDeadline != 0 && cfg.AckDeadline != existing.AckDeadline {
+		update.AckDeadline = cfg.AckDeadline
+		changed = true
+	}
+	if cfg.RetentionDuration != 0 && cfg.RetentionDuration != existing.RetentionDuration {
+		update.RetentionDuration = cfg.RetentionDuration
+		changed = true
+	}
+	if policy := cfg.deadLetterPolicy(); policy != nil {
+		if existing.DeadLetterPolicy == nil || *existing.DeadLetterPolicy != *policy {
+			update.DeadLetterPolicy = policy
+			changed = true
+		}
+	}
+	return update, changed
+}
@@ -0,0 +1,109 @@
+package source
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestEnsureSubscription(t *testing.T) {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	client := newTestClient(t)
+	l := zaptest.NewLogger(t)
+
+	topic, err := client.CreateTopic(ctx, "scan-topic")
+	assert.NoError(t, err)
+	dlq, err := client.CreateTopic(ctx, "scan-dlq")
+	assert.NoError(t, err)
+
+	cfg := SubscriptionConfig{
+		ID:                "scan-sub",
+		Topic:             topic,
+		AckDeadline:       time.Second * 30,
+		RetentionDuration: time.Hour * 24,
+		Filter:            `attributes.source = "scanner"`,
+	}
+
+	// first run creates it
+	sub, err := EnsureSubscription(ctx, l, client, cfg)
+	assert.NoError(t, err)
+	got, err := sub.Config(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second*30, got.AckDeadline)
+	assert.Equal(t, time.Hour*24, got.RetentionDuration)
+	assert.Equal(t, cfg.Filter, got.Filter)
+	assert.Nil(t, got.DeadLetterPolicy)
+
+	// second run reuses it and updates the mutable settings
+	cfg.AckDeadline = time.Second * 60
+	cfg.DeadLetterTopic = dlq
+	cfg.MaxDeliveryAttempts = 5
+	sub, err = EnsureSubscription(ctx, l, client, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "scan-sub", sub.ID())
+	got, err = sub.Config(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second*60, got.AckDeadline)
+	if assert.NotNil(t, got.DeadLetterPolicy) {
+		assert.Equal(t, dlq.String(), got.DeadLetterPolicy.DeadLetterTopic)
+		assert.Equal(t, 5, got.DeadLetterPolicy.MaxDeliveryAttempts)
+	}
+
+	subs := client.Subscriptions(ctx)
+	count := 0
+	for {
+		if _, err := subs.Next(); err != nil {
+			break
+		}
+		count++
+	}
+	assert.Equal(t, 1, count, "should not have created a second subscription")
+}
+
+func TestPubSubSourceCloseKeepsSubscription(t *testing.T) {
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	client := newTestClient(t)
+
+	topic, err := client.CreateTopic(ctx, "scan-topic")
+	assert.NoError(t, err)
+	sub, err := EnsureSubscription(ctx, zaptest.NewLogger(t), client, SubscriptionConfig{
+		ID:    "scan-sub",
+		Topic: topic,
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, NewPubSubSource(sub).Close(ctx))
+	exists, err := sub.Exists(ctx)
+	assert.NoError(t, err)
+	assert.True(t, exists, "subscription should survive a shutdown by default")
+
+	assert.NoError(t, NewPubSubSource(sub, WithDeleteOnClose()).Close(ctx))
+	exists, err = sub.Exists(ctx)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func newTestClient(t *testing.T) *pubsub.Client {
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal("failed to dial pstest server", err)
+	}
+	client, err := pubsub.NewClient(context.Background(), "test-project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal("failed to create pubsub client", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
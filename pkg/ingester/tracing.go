@@ -0,0 +1,14 @@
+package ingester
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/censys/scan-takehome/pkg/ingester"
+
+// tracer is looked up on every use rather than once at startup, so whatever
+// provider is installed globally (including in tests) is the one we use.
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
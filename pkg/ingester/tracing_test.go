@@ -0,0 +1,91 @@
+package ingester
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestTracingFollowsMessageThroughFlush(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	l := zaptest.NewLogger(t)
+	subject := NewIngester(l, nil)
+	var wg sync.WaitGroup
+	upserter := NewUpserter(l, subject.SendChan, &mockRepo{}, time.Hour, 10)
+	upsertCtx, stop := context.WithCancel(ctx)
+	wg.Add(1)
+	go upserter.Start(upsertCtx, &wg)
+
+	// the publisher's span, as it would show up in the pubsub attributes.
+	parentTraceID := "4bf92f3577b34da6a3ce929d0e0736aa"
+	parent := map[string]string{"traceparent": "00-" + parentTraceID + "-00f067aa0ba902b7-01"}
+
+	other := newScan(2)
+	other.Port = 8080
+	msgs := []*mockMsg{newMockMsg(), newMockMsg()}
+	var received sync.WaitGroup
+	received.Add(2)
+	go func() {
+		defer received.Done()
+		subject.receiveMessage(ctx, ScanToBytes(t, newScan(1)), MessageInfo{ID: "1", Attributes: parent}, msgs[0])
+	}()
+	go func() {
+		defer received.Done()
+		subject.receiveMessage(ctx, ScanToBytes(t, other), MessageInfo{ID: "2"}, msgs[1])
+	}()
+
+	// give both messages time to make it into the batch, then flush on shutdown.
+	time.Sleep(time.Millisecond * 100)
+	stop()
+	wg.Wait()
+	for _, m := range msgs {
+		<-m.Done
+		assert.True(t, m.acked)
+	}
+	received.Wait()
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = append(spans[s.Name()], s)
+	}
+	for _, name := range []string{"ingester.receive", "ingester.parse", "upserter.batch_wait"} {
+		assert.Len(t, spans[name], 2, name)
+	}
+
+	var receiveSpans []trace.SpanContext
+	for _, s := range spans["ingester.receive"] {
+		receiveSpans = append(receiveSpans, s.SpanContext())
+		if s.Parent().IsValid() {
+			assert.Equal(t, parentTraceID, s.SpanContext().TraceID().String(), "trace context should come from the message attributes")
+		}
+	}
+
+	if assert.Len(t, spans["upserter.flush"], 1) {
+		flush := spans["upserter.flush"][0]
+		var linked []trace.SpanContext
+		for _, link := range flush.Links() {
+			linked = append(linked, link.SpanContext)
+		}
+		assert.ElementsMatch(t, receiveSpans, linked, "the flush should link to every message in the batch")
+	}
+}
@@ -2,19 +2,115 @@ package ingester
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// ErrRecordRejected is wrapped by repository errors that are down to what's in
+// the records (bad data, constraint violations) rather than the data store
+// itself. Anything else is treated as transient.
+var ErrRecordRejected = errors.New("record rejected by the data store")
+
 type UpsertRepository interface {
-	UpsertMany(ctx context.Context, scans []Scan) error
+	// UpsertMany saves the scans, reporting what happened to the rows they
+	// landed on.
+	UpsertMany(ctx context.Context, scans []Scan) (UpsertStats, error)
+}
+
+// HistoryRecorder keeps every observation, not only the latest. Scans that
+// can't change the latest results, because they're stale or superseded, skip
+// the upsert and only go here.
+type HistoryRecorder interface {
+	RecordHistory(ctx context.Context, scans []Scan) error
+}
+
+// UpsertStats counts what an upsert did to the latest scan results, one per
+// ip/port/transport/service.
+type UpsertStats struct {
+	// New is rows that didn't exist before.
+	New int
+	// Changed is rows where the response is different to the one saved.
+	Changed int
+	// Unchanged is rows seen again with the same response, where only
+	// last_seen and seen_count move.
+	Unchanged int
+	// Stale is scans older than the row already saved, which change nothing.
+	Stale int
+}
+
+// Add adds the counts from o.
+func (s *UpsertStats) Add(o UpsertStats) {
+	s.New += o.New
+	s.Changed += o.Changed
+	s.Unchanged += o.Unchanged
+	s.Stale += o.Stale
+}
+
+// RecordStatus is how a scan compares to the newest one the cache has seen
+// for the same ip/port/transport/service.
+type RecordStatus int
+
+const (
+	// RecordStale means the cache already has a scan at least as new.
+	RecordStale RecordStatus = iota
+	// RecordNew means the cache has never seen the key.
+	RecordNew
+	// RecordNewer means the scan is newer than the one in the cache.
+	RecordNewer
+)
+
+func (s RecordStatus) String() string {
+	switch s {
+	case RecordStale:
+		return "stale"
+	case RecordNew:
+		return "new"
+	case RecordNewer:
+		return "newer"
+	default:
+		return "unknown"
+	}
+}
+
+// RecordCheck is the result of checking a single scan against the cache.
+type RecordCheck struct {
+	Status RecordStatus
+	// Previous is the timestamp the check replaced when the scan was newer,
+	// and zero otherwise.
+	Previous int64
+}
+
+// RecordRestore puts back what was cached before a scan was checked, so a
+// scan that failed to save doesn't leave its timestamp behind.
+type RecordRestore struct {
+	Record Scan
+	// Previous is the timestamp to put back, zero if the key should be
+	// removed.
+	Previous int64
 }
 
 type RecordCache interface {
-	RecordIsNew(ctx context.Context, record Scan) (bool, error)
-	RemoveRecords(ctx context.Context, records []Scan) (int64, error)
+	// CheckRecord compares the scan against the cache and, unless it's stale,
+	// stores its timestamp as the newest. The check and the update have to
+	// happen atomically, since multiple workers can see the same key at once.
+	CheckRecord(ctx context.Context, record Scan) (RecordStatus, error)
+	// CheckRecords does the same as CheckRecord for a whole batch at once,
+	// returning a result for each record in the same order. If an error is
+	// returned, none of the records should be trusted as checked.
+	CheckRecords(ctx context.Context, records []Scan) ([]RecordCheck, error)
+	// RestoreRecords undoes the updates from CheckRecords. A key is only put
+	// back if it still holds the timestamp of the restored record, so anything
+	// newer written in the meantime is left alone. Returns how many keys were
+	// restored.
+	RestoreRecords(ctx context.Context, restores []RecordRestore) (int64, error)
 }
 
 type Upserter struct {
@@ -24,9 +120,13 @@ type Upserter struct {
 	Repository    UpsertRepository
 	Log           *zap.Logger
 	// keep the batch private so we can move it to a different structure (or service)
-	batch []*messageRequest
-	mu    sync.Mutex
-	cache RecordCache
+	batch batch
+	// superseded are older scans for keys already in the batch. They've been
+	// acked, and are only waiting to go to the history with the next flush.
+	superseded []Scan
+	mu         sync.Mutex
+	cache      RecordCache
+	history    HistoryRecorder
 }
 
 type UpserterOption func(u *Upserter)
@@ -37,6 +137,14 @@ func WithCache(c RecordCache) UpserterOption {
 	}
 }
 
+// WithHistory sends the scans that are skipped (stale or superseded) to the
+// history on each flush. Without it they're just acked.
+func WithHistory(h HistoryRecorder) UpserterOption {
+	return func(u *Upserter) {
+		u.history = h
+	}
+}
+
 // NewUpserter will create a new Upserter service struct.
 func NewUpserter(
 	log *zap.Logger,
@@ -49,7 +157,7 @@ func NewUpserter(
 		Log:           log,
 		MsgChan:       msgChan,
 		BatchSize:     batchSize,
-		batch:         []*messageRequest{},
+		batch:         batch{},
 		FlushInterval: flushInterval,
 		Repository:    repo,
 	}
@@ -81,14 +189,27 @@ func (u *Upserter) Start(ctx context.Context, wg *sync.WaitGroup) error {
 			wg.Done()
 			return nil
 		case msg := <-u.MsgChan:
-			if !u.shouldContinueProcessing(ctx, msg.scan) {
-				msg.Res <- messageResponse{}
-				continue
-			}
+			// stale scans are weeded out in bulk when the batch is flushed,
+			// rather than paying for a trip to the cache on every message.
+			_, msg.waitSpan = tracer().Start(trace.ContextWithSpanContext(ctx, msg.spanCtx), "upserter.batch_wait")
 			u.mu.Lock()
-			u.batch = append(u.batch, msg)
+			superseded := u.batch.add(msg)
+			if superseded != nil && u.history != nil {
+				u.superseded = append(u.superseded, superseded.scan)
+			}
+			size := len(u.batch)
 			u.mu.Unlock()
-			if len(u.batch) > u.BatchSize {
+			if superseded != nil {
+				// a newer scan for the same ip/port/transport/service is already waiting
+				// to be saved, so there's nothing to do for this one beyond the history.
+				u.Log.Debug("scan superseded by a newer scan in the batch", zap.String("key", superseded.scan.Key()))
+				scansSkipped.WithLabelValues("superseded").Inc()
+				if superseded.waitSpan != nil {
+					superseded.waitSpan.SetAttributes(attribute.Bool("upserter.superseded", true))
+				}
+				superseded.respond(messageResponse{})
+			}
+			if size > u.BatchSize {
 				u.Flush()
 				// technically we aren't restarting the timer here, but it's not a bad idea.
 			}
@@ -101,42 +222,178 @@ func (u *Upserter) Flush() {
 	// hardcoding a 60 second timeout. Could be configurable if more time is needed.
 	ctx, fn := context.WithTimeout(context.Background(), time.Second*60)
 	defer fn()
-	u.Log.Debug("flushing entries to data store", zap.Int("count", len(u.batch)))
 	u.mu.Lock()
-	copiedMessages := make([]*messageRequest, len(u.batch))
-	copy(copiedMessages, u.batch)
-	u.batch = u.batch[:0]
+	copiedMessages := u.batch.messages()
+	superseded := u.superseded
+	u.batch = batch{}
+	u.superseded = nil
 	u.mu.Unlock()
+	u.Log.Debug("flushing entries to data store", zap.Int("count", len(copiedMessages)), zap.Int("superseded", len(superseded)))
 
-	records := make([]Scan, len(copiedMessages))
-	for i, msg := range copiedMessages {
-		records[i] = msg.scan
+	links := make([]trace.Link, 0, len(copiedMessages))
+	for _, msg := range copiedMessages {
+		if msg.spanCtx.IsValid() {
+			links = append(links, trace.Link{SpanContext: msg.spanCtx})
+		}
+	}
+
+	// a flush covers messages from many traces, so it gets its own trace and
+	// links back to each message instead of picking one parent.
+	ctx, span := tracer().Start(ctx, "upserter.flush",
+		trace.WithNewRoot(),
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("upserter.batch_size", len(copiedMessages))),
+	)
+	defer span.End()
+
+	msgs, stale := u.dropStale(ctx, copiedMessages)
+	start := time.Now()
+	stats, failed := u.upsert(ctx, msgs)
+	poisoned := 0
+	for _, f := range failed {
+		if f.poison {
+			poisoned++
+		}
+	}
+	flushResult := "success"
+	switch {
+	case len(failed) == 0:
+	case len(failed) == len(msgs):
+		flushResult = "error"
+	default:
+		flushResult = "partial"
+	}
+	flushDuration.WithLabelValues(flushResult).Observe(time.Since(start).Seconds())
+	batchSize.Observe(float64(len(msgs)))
+	rowsUpserted.WithLabelValues("new").Add(float64(stats.New))
+	rowsUpserted.WithLabelValues("changed").Add(float64(stats.Changed))
+	rowsUpserted.WithLabelValues("unchanged").Add(float64(stats.Unchanged))
+	rowsUpserted.WithLabelValues("stale").Add(float64(stats.Stale))
+	span.SetAttributes(
+		attribute.Int("upserter.rows.new", stats.New),
+		attribute.Int("upserter.rows.changed", stats.Changed),
+		attribute.Int("upserter.rows.unchanged", stats.Unchanged),
+		attribute.Int("upserter.rows.stale", stats.Stale),
+	)
+	u.Log.Debug("flushed entries to data store",
+		zap.Int("new", stats.New),
+		zap.Int("changed", stats.Changed),
+		zap.Int("unchanged", stats.Unchanged),
+		zap.Int("stale", stats.Stale),
+	)
 
+	if len(failed) > 0 {
+		span.SetAttributes(
+			attribute.Int("upserter.failed", len(failed)),
+			attribute.Int("upserter.poison", poisoned),
+		)
+		span.SetStatus(codes.Error, "failed to save records")
+		scansFailed.WithLabelValues("poison").Add(float64(poisoned))
+		scansFailed.WithLabelValues("transient").Add(float64(len(failed) - poisoned))
+		u.Log.Error("error flushing records to data store!",
+			zap.Int("failed", len(failed)),
+			zap.Int("poison", poisoned),
+			zap.Int("count", len(msgs)),
+		)
+		u.restoreCache(ctx, failed)
 	}
 
-	// UpsertMany is transactional, so this is an all or nothing deal
-	// The tradeoff means that any records that would've been ack'd are
-	// going to get nack'd and we'll need to accept that they'll come again
-	// later.
-	err := u.Repository.UpsertMany(ctx, records)
-	if err != nil {
-		u.Log.Error("error flushing records to data store!", zap.Error(err))
-		u.Log.Warn("removing redis keys that previously existed")
-		if res, err := u.cache.RemoveRecords(ctx, records); err != nil {
-			u.Log.Error("error removing records from cache", zap.Error(err))
+	for _, msg := range msgs {
+		if f, ok := failed[msg]; ok {
+			msg.respond(messageResponse{err: f.err, poison: f.poison})
 		} else {
-			u.Log.Debug("removed records from cache", zap.Int64("count", res))
+			msg.respond(messageResponse{})
 		}
 	}
 
-	res := messageResponse{
-		err: err,
+	u.recordHistory(ctx, append(superseded, stale...))
+}
+
+// recordHistory sends the scans that skipped the upsert to the history. They've
+// been acked already, so this is best effort: if it fails they're missing from
+// the history, but the latest results are no different.
+func (u *Upserter) recordHistory(ctx context.Context, scans []Scan) {
+	if u.history == nil || len(scans) == 0 {
+		return
+	}
+	ctx, span := tracer().Start(ctx, "upserter.record_history",
+		trace.WithAttributes(attribute.Int("upserter.history_size", len(scans))),
+	)
+	defer span.End()
+	if err := u.history.RecordHistory(ctx, scans); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to record history")
+		historyFailed.Add(float64(len(scans)))
+		u.Log.Error("error recording skipped scans in the history", zap.Int("count", len(scans)), zap.Error(err))
 	}
+}
 
-	for _, msg := range copiedMessages {
-		msg.Res <- res
+// upsertFailure is why a message couldn't be saved.
+type upsertFailure struct {
+	err error
+	// poison is set when the record was rejected on its own, so retrying it
+	// isn't going to help.
+	poison bool
+}
+
+// upsert saves the messages and returns the stats for the ones that were saved,
+// and the ones that couldn't be saved along with why. UpsertMany is
+// transactional, so one bad record takes the rest of the batch down with it.
+// When the data store rejects a batch because of what's in it, the batch is
+// split in half and each half is tried again, until we're left with only the
+// records that are rejected on their own. Those are poison. Any other error
+// (or running out of time) means the data store is having a bad time, so
+// whatever is left is retried later instead.
+func (u *Upserter) upsert(ctx context.Context, msgs []*messageRequest) (UpsertStats, map[*messageRequest]upsertFailure) {
+	records := make([]Scan, len(msgs))
+	for i, msg := range msgs {
+		records[i] = msg.scan
+	}
+	stats, err := u.Repository.UpsertMany(ctx, records)
+	if err == nil {
+		return stats, nil
 	}
 
+	failed := map[*messageRequest]upsertFailure{}
+	rejected := errors.Is(err, ErrRecordRejected) && ctx.Err() == nil
+	if len(msgs) == 1 || !rejected {
+		for _, msg := range msgs {
+			failed[msg] = upsertFailure{err: err, poison: rejected}
+		}
+		return UpsertStats{}, failed
+	}
+	u.Log.Debug("batch failed, splitting to find the bad records", zap.Int("count", len(msgs)), zap.Error(err))
+	mid := len(msgs) / 2
+	stats, failedFirst := u.upsert(ctx, msgs[:mid])
+	rest, failedRest := u.upsert(ctx, msgs[mid:])
+	stats.Add(rest)
+	maps.Copy(failed, failedFirst)
+	maps.Copy(failed, failedRest)
+	return stats, failed
+}
+
+// restoreCache puts back whatever the cache held before the failed records
+// were checked. Deleting the keys would lose the timestamp of the last scan
+// that was actually saved, and let an older redelivery in.
+func (u *Upserter) restoreCache(ctx context.Context, failed map[*messageRequest]upsertFailure) {
+	if u.cache == nil {
+		return
+	}
+	restores := make([]RecordRestore, 0, len(failed))
+	for msg := range failed {
+		if msg.restore != nil {
+			restores = append(restores, *msg.restore)
+		}
+	}
+	if len(restores) == 0 {
+		return
+	}
+	u.Log.Warn("restoring cache entries for records that failed to save", zap.Int("count", len(restores)))
+	if res, err := u.cache.RestoreRecords(ctx, restores); err != nil {
+		u.Log.Error("error restoring records in cache", zap.Error(err))
+	} else {
+		u.Log.Debug("restored records in cache", zap.Int64("count", res))
+	}
 }
 
 func (u *Upserter) flushWithInterval(ctx context.Context) error {
@@ -153,17 +410,44 @@ func (u *Upserter) flushWithInterval(ctx context.Context) error {
 	}
 }
 
-func (u *Upserter) shouldContinueProcessing(ctx context.Context, record Scan) bool {
-	if u.cache == nil {
-		u.Log.Debug("cache not enabled")
-		return true
+// dropStale checks the whole batch against the cache in one go, and answers
+// for any scan that's no newer than what's already been seen. Whatever is left
+// still needs saving. The stale scans are returned for the history.
+func (u *Upserter) dropStale(ctx context.Context, msgs []*messageRequest) ([]*messageRequest, []Scan) {
+	if u.cache == nil || len(msgs) == 0 {
+		return msgs, nil
+	}
+	ctx, span := tracer().Start(ctx, "upserter.cache_check")
+	defer span.End()
+
+	records := make([]Scan, len(msgs))
+	for i, msg := range msgs {
+		records[i] = msg.scan
+	}
+	checks, err := u.cache.CheckRecords(ctx, records)
+	if err == nil && len(checks) != len(records) {
+		err = fmt.Errorf("cache returned %d results for %d records", len(checks), len(records))
 	}
-	ok, err := u.cache.RecordIsNew(ctx, record)
 	if err != nil {
-		u.Log.Error("error attempting to retreive cache record, processing as if it isn't seen", zap.Error(err))
-		return true
+		span.RecordError(err)
+		u.Log.Error("error attempting to retreive cache records, processing as if they aren't seen", zap.Error(err))
+		return msgs, nil
 	}
 
-	return ok
-
+	fresh := make([]*messageRequest, 0, len(msgs))
+	var stale []Scan
+	for i, msg := range msgs {
+		if checks[i].Status == RecordStale {
+			scansSkipped.WithLabelValues("stale").Inc()
+			msg.respond(messageResponse{})
+			if u.history != nil {
+				stale = append(stale, msg.scan)
+			}
+			continue
+		}
+		msg.restore = &RecordRestore{Record: msg.scan, Previous: checks[i].Previous}
+		fresh = append(fresh, msg)
+	}
+	span.SetAttributes(attribute.Int("upserter.stale", len(msgs)-len(fresh)))
+	return fresh, stale
 }
@@ -2,6 +2,7 @@ package ingester
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
@@ -97,7 +98,7 @@ func TestCachePreventsOoOInsertions(t *testing.T) {
 		res: []Scan{},
 	}
 	subject := NewUpserter(l, msgChan, repo, time.Second*1, 20,
-		WithCache(&mockCache{map[string]int64{}}),
+		WithCache(&mockCache{cache: map[string]int64{}}),
 	)
 
 	go subject.Start(ctx, &wg)
@@ -116,13 +117,383 @@ func TestCachePreventsOoOInsertions(t *testing.T) {
 	fn()
 }
 
+func TestFlushIsolatesPoisonRecords(t *testing.T) {
+	messages := makeMessages(7)
+	tests := []struct {
+		name           string
+		repo           *mockRepo
+		expectedSaved  int
+		expectedFailed []string
+		expectPoison   bool
+	}{
+		{
+			name:          "no failures is a single call",
+			repo:          &mockRepo{},
+			expectedSaved: 7,
+		},
+		{
+			name:           "single bad record",
+			repo:           &mockRepo{poison: map[string]bool{messages[3].Key(): true}},
+			expectedSaved:  6,
+			expectedFailed: []string{messages[3].Key()},
+			expectPoison:   true,
+		},
+		{
+			name: "bad records in both halves",
+			repo: &mockRepo{poison: map[string]bool{
+				messages[0].Key(): true,
+				messages[6].Key(): true,
+			}},
+			expectedSaved:  5,
+			expectedFailed: []string{messages[0].Key(), messages[6].Key()},
+			expectPoison:   true,
+		},
+		{
+			name:           "whole batch failing is transient",
+			repo:           &mockRepo{err: errors.New("test-error: connection refused")},
+			expectedFailed: keys(messages),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &mockCache{cache: map[string]int64{}}
+			subject := NewUpserter(zaptest.NewLogger(t), nil, tt.repo, time.Hour, 20, WithCache(cache))
+			responses := map[string]chan messageResponse{}
+			for _, msg := range messages {
+				res := make(chan messageResponse, 1)
+				responses[msg.Key()] = res
+				subject.batch.add(&messageRequest{scan: msg, Res: res})
+			}
+
+			subject.Flush()
+
+			assert.Len(t, tt.repo.res, tt.expectedSaved)
+			var failed []string
+			for key, resChan := range responses {
+				res := <-resChan
+				if res.err != nil {
+					failed = append(failed, key)
+					assert.Equal(t, tt.expectPoison, res.poison, key)
+				}
+			}
+			assert.ElementsMatch(t, tt.expectedFailed, failed)
+			if len(tt.expectedFailed) == 0 {
+				assert.Equal(t, 1, tt.repo.calls)
+			}
+			for _, key := range tt.expectedFailed {
+				assert.NotContains(t, cache.cache, key, "failed records should be removed from the cache")
+			}
+		})
+	}
+}
+
+// Only the data store rejecting a record on its own makes it poison. Anything
+// else going wrong while the batch is being split up has to be retried, not
+// dead lettered, even when some of the batch saved.
+func TestTransientFailureWhileSplittingIsNacked(t *testing.T) {
+	messages := makeMessages(6)
+	poison, flaky := messages[0], messages[5]
+	repo := &mockRepo{poison: map[string]bool{poison.Key(): true}, flaky: map[string]bool{flaky.Key(): true}}
+	ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+	defer fn()
+	dlq := &mockDeadLetterer{}
+	ingest := NewIngester(zaptest.NewLogger(t), nil, WithDeadLetter(dlq))
+	subject := NewUpserter(zaptest.NewLogger(t), ingest.SendChan, repo, time.Hour, 20)
+
+	mms := map[string]*mockMsg{}
+	for i, scan := range messages {
+		mm := newMockMsg()
+		mms[scan.Key()] = mm
+		go ingest.receiveMessage(ctx, ScanToBytes(t, scan.Scan), MessageInfo{ID: fmt.Sprint(i)}, mm)
+	}
+	// stand in for Start, so the whole lot goes out in a single flush.
+	for range messages {
+		subject.batch.add(<-ingest.SendChan)
+	}
+	subject.Flush()
+
+	for _, mm := range mms {
+		<-mm.Done
+	}
+	assert.True(t, mms[poison.Key()].acked, "the poison record is dead lettered and acked")
+	assert.True(t, mms[flaky.Key()].nacked, "a transient error is no reason to give up on a scan")
+	if assert.Len(t, dlq.letters, 1, "only the poison record is dead lettered") {
+		assert.Equal(t, "0", dlq.letters[0].MessageID)
+	}
+	assert.NotEmpty(t, repo.res, "the records that don't share a half with either should save")
+}
+
+func TestUpsertAddsUpStatsAcrossSplits(t *testing.T) {
+	messages := makeMessages(7)
+	repo := &mockRepo{poison: map[string]bool{messages[0].Key(): true, messages[6].Key(): true}}
+	subject := NewUpserter(zaptest.NewLogger(t), nil, repo, time.Hour, 20)
+	msgs := make([]*messageRequest, len(messages))
+	for i, msg := range messages {
+		msgs[i] = &messageRequest{scan: msg}
+	}
+
+	stats, failed := subject.upsert(context.Background(), msgs)
+	assert.Len(t, failed, 2)
+	assert.Equal(t, UpsertStats{New: 5}, stats, "only the halves that saved count")
+}
+
+func TestFlushWithoutCache(t *testing.T) {
+	messages := makeMessages(2)
+	repo := &mockRepo{poison: map[string]bool{messages[0].Key(): true}}
+	subject := NewUpserter(zaptest.NewLogger(t), nil, repo, time.Hour, 20)
+	res := make(chan messageResponse, len(messages))
+	for _, msg := range messages {
+		subject.batch.add(&messageRequest{scan: msg, Res: res})
+	}
+
+	// used to panic trying to clean up a cache that isn't there.
+	subject.Flush()
+	assert.Len(t, repo.res, 1)
+	assert.Len(t, res, 2)
+}
+
+func keys(scans []Scan) []string {
+	out := []string{}
+	for _, scan := range scans {
+		out = append(out, scan.Key())
+	}
+	return out
+}
+
+// The cache should be checked once per flush, not once per message.
+func TestFlushChecksCacheInBulk(t *testing.T) {
+	messages := makeMessages(5)
+	stale := messages[2]
+	cache := &mockCache{cache: map[string]int64{stale.Key(): stale.Timestamp}}
+	repo := &mockRepo{}
+	subject := NewUpserter(zaptest.NewLogger(t), nil, repo, time.Hour, 20, WithCache(cache))
+	responses := make(chan messageResponse, len(messages))
+	for _, msg := range messages {
+		subject.batch.add(&messageRequest{scan: msg, Res: responses})
+	}
+
+	subject.Flush()
+	assert.Equal(t, 1, cache.batches)
+	assert.Len(t, responses, len(messages), "stale scans should be answered too")
+	assert.Len(t, repo.res, 4)
+	assert.NotContains(t, keys(repo.res), stale.Key())
+}
+
+func TestFlushSavesEverythingWhenCacheFails(t *testing.T) {
+	messages := makeMessages(3)
+	cache := &mockCache{cache: map[string]int64{}, err: errors.New("test-error")}
+	repo := &mockRepo{}
+	subject := NewUpserter(zaptest.NewLogger(t), nil, repo, time.Hour, 20, WithCache(cache))
+	responses := make(chan messageResponse, len(messages))
+	for _, msg := range messages {
+		subject.batch.add(&messageRequest{scan: msg, Res: responses})
+	}
+
+	subject.Flush()
+	assert.Len(t, repo.res, 3, "the database still checks ordering, so save everything")
+	for range messages {
+		assert.NoError(t, (<-responses).err)
+	}
+}
+
+// A failed flush has to put back what the cache knew before, rather than
+// forgetting the key and letting an older redelivery through.
+func TestFlushFailureRestoresCache(t *testing.T) {
+	saved := makeMessages(1)[0]
+	saved.Timestamp = time.Now().Add(time.Minute * -10).Unix()
+	newer := saved
+	newer.Timestamp = time.Now().Unix()
+	older := saved
+	older.Timestamp = time.Now().Add(time.Minute * -20).Unix()
+	unseen := makeMessages(2)[1]
+
+	cache := &mockCache{cache: map[string]int64{saved.Key(): saved.Timestamp}}
+	repo := &mockRepo{err: errors.New("test-error")}
+	subject := NewUpserter(zaptest.NewLogger(t), nil, repo, time.Hour, 20, WithCache(cache))
+	res := make(chan messageResponse, 2)
+	subject.batch.add(&messageRequest{scan: newer, Res: res})
+	subject.batch.add(&messageRequest{scan: unseen, Res: res})
+
+	subject.Flush()
+	assert.Error(t, (<-res).err)
+	assert.Equal(t, saved.Timestamp, cache.cache[saved.Key()], "the last saved timestamp should be put back")
+	assert.NotContains(t, cache.cache, unseen.Key(), "keys that weren't cached before should be removed")
+
+	check := cache.check(older)
+	assert.Equal(t, RecordStale, check.Status, "an older redelivery is still stale")
+}
+
+func TestRestoreLeavesNewerValuesAlone(t *testing.T) {
+	scan := makeMessages(1)[0]
+	cache := &mockCache{cache: map[string]int64{}}
+	subject := NewUpserter(zaptest.NewLogger(t), nil, &mockRepo{}, time.Hour, 20, WithCache(cache))
+	msg := &messageRequest{scan: scan, Res: make(chan messageResponse, 1)}
+	subject.dropStale(context.Background(), []*messageRequest{msg})
+
+	// another worker saves something newer before our flush fails
+	cache.cache[scan.Key()] = scan.Timestamp + 10
+	subject.restoreCache(context.Background(), map[*messageRequest]upsertFailure{msg: {err: errors.New("test-error")}})
+	assert.Equal(t, scan.Timestamp+10, cache.cache[scan.Key()])
+}
+
+// A newer scan for a key the cache has already seen has to be saved, not just
+// the first one.
+func TestCacheAllowsNewerScans(t *testing.T) {
+	older := makeMessages(1)[0]
+	older.Timestamp = time.Now().Add(time.Second * -60).Unix()
+	newer := older
+	newer.Timestamp = time.Now().Unix()
+
+	ctx, fn := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer fn()
+	var wg sync.WaitGroup
+	msgChan := make(chan *messageRequest)
+	responseChan := make(chan messageResponse, 3)
+	repo := &mockRepo{}
+	// a batch size of zero flushes after every message, so each scan gets
+	// checked against the cache on its own.
+	subject := NewUpserter(zaptest.NewLogger(t), msgChan, repo, time.Second*10, 0,
+		WithCache(&mockCache{cache: map[string]int64{}}),
+	)
+
+	wg.Add(1)
+	go subject.Start(ctx, &wg)
+	for _, msg := range []Scan{older, newer, older} {
+		msgChan <- &messageRequest{scan: msg, Res: responseChan}
+	}
+	wg.Wait()
+
+	assert.Len(t, responseChan, 3)
+	if assert.Len(t, repo.res, 2, "the newer scan should be saved, the late older one skipped") {
+		assert.Equal(t, newer.Timestamp, repo.res[1].Timestamp)
+	}
+}
+
+func TestUpserterCoalescesDuplicateKeys(t *testing.T) {
+	now := time.Now()
+	newest := makeMessages(1)[0]
+	newest.Timestamp = now.Unix()
+	newest.Response = "newest"
+	older := newest
+	older.Timestamp = now.Add(time.Second * -30).Unix()
+	older.Response = "older"
+	oldest := newest
+	oldest.Timestamp = now.Add(time.Second * -60).Unix()
+	oldest.Response = "oldest"
+	other := makeMessages(2)[1]
+
+	// send the newest in the middle so we cover both replacing the waiting
+	// message and throwing away the incoming one.
+	messages := []Scan{older, newest, oldest, other}
+
+	ctx, fn := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer fn()
+	var wg sync.WaitGroup
+	l := zaptest.NewLogger(t)
+	msgChan := make(chan *messageRequest)
+	responseChan := make(chan messageResponse, len(messages))
+	repo := &mockRepo{
+		res: []Scan{},
+	}
+	subject := NewUpserter(l, msgChan, repo, time.Second*10, 20)
+
+	wg.Add(1)
+	go subject.Start(ctx, &wg)
+	for _, msg := range messages {
+		msgChan <- &messageRequest{
+			scan: msg,
+			Res:  responseChan,
+		}
+	}
+
+	wg.Wait()
+	assert.Equal(t, len(messages), len(responseChan), "every message should get an answer")
+	for len(responseChan) > 0 {
+		assert.NoError(t, (<-responseChan).err)
+	}
+	assert.Equal(t, 1, repo.timesHit)
+	if assert.Len(t, repo.res, 2, "duplicate keys should be coalesced") {
+		saved := map[string]Scan{}
+		for _, scan := range repo.res {
+			saved[scan.Key()] = scan
+		}
+		assert.Equal(t, "newest", saved[newest.Key()].Response)
+		assert.Contains(t, saved, other.Key())
+	}
+}
+
+// Stale and superseded scans are acked without being upserted, and only go to
+// the history once the batch is flushed.
+func TestSkippedScansOnlyGoToHistory(t *testing.T) {
+	messages := makeMessages(3)
+	newest := messages[0]
+	superseded := newest
+	superseded.Timestamp -= 30
+	stale := messages[1]
+	cache := &mockCache{cache: map[string]int64{stale.Key(): stale.Timestamp + 10}}
+	repo := &mockRepo{}
+	subject := NewUpserter(zaptest.NewLogger(t), nil, repo, time.Hour, 20, WithCache(cache), WithHistory(repo))
+
+	ctx, fn := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer fn()
+	var wg sync.WaitGroup
+	msgChan := make(chan *messageRequest)
+	subject.MsgChan = msgChan
+	// a batch size of 2 would flush on a third message, superseded scans
+	// shouldn't count towards it.
+	subject.BatchSize = 2
+	responseChan := make(chan messageResponse, 4)
+	wg.Add(1)
+	go subject.Start(ctx, &wg)
+	for _, scan := range []Scan{newest, superseded, stale} {
+		msgChan <- &messageRequest{scan: scan, Res: responseChan}
+	}
+	assert.Eventually(t, func() bool { return len(responseChan) == 1 }, time.Millisecond*200, time.Millisecond*10,
+		"the superseded scan should be acked straight away")
+	assert.Zero(t, repo.calls, "superseded scans don't count towards the batch size")
+
+	msgChan <- &messageRequest{scan: messages[2], Res: responseChan}
+	wg.Wait()
+	assert.Len(t, responseChan, 4)
+	for len(responseChan) > 0 {
+		assert.NoError(t, (<-responseChan).err)
+	}
+	assert.ElementsMatch(t, []string{newest.Key(), messages[2].Key()}, keys(repo.res), "only fresh scans are upserted")
+	if assert.Len(t, repo.history, 2) {
+		assert.ElementsMatch(t, []int64{superseded.Timestamp, stale.Timestamp}, []int64{repo.history[0].Timestamp, repo.history[1].Timestamp})
+	}
+}
+
+// The skipped scans have been acked already, so failing to record them in the
+// history mustn't fail anything else.
+func TestHistoryFailureDoesntFailTheFlush(t *testing.T) {
+	messages := makeMessages(2)
+	stale := messages[1]
+	cache := &mockCache{cache: map[string]int64{stale.Key(): stale.Timestamp}}
+	repo := &mockRepo{historyErr: errors.New("test-error")}
+	subject := NewUpserter(zaptest.NewLogger(t), nil, repo, time.Hour, 20, WithCache(cache), WithHistory(repo))
+	responses := make(chan messageResponse, len(messages))
+	for _, msg := range messages {
+		subject.batch.add(&messageRequest{scan: msg, Res: responses})
+	}
+
+	subject.Flush()
+	assert.Len(t, repo.res, 1)
+	assert.Equal(t, 1, repo.historyCalls)
+	for range messages {
+		assert.NoError(t, (<-responses).err)
+	}
+}
+
+// makeMessages creates count scans, each for a different port so they don't
+// get coalesced in the batch.
 func makeMessages(count int) []Scan {
 	scans := []Scan{}
 	for i := 0; i < count; i++ {
 		scans = append(scans, Scan{
 			Scan: scanning.Scan{
 				Ip:          "1.1.1.1",
-				Port:        53,
+				Port:        uint32(53 + i),
 				Service:     "DNS",
 				Timestamp:   time.Now().Add(time.Second * time.Duration(i)).Unix(),
 				DataVersion: 2,
@@ -137,33 +508,116 @@ func makeMessages(count int) []Scan {
 
 type mockCache struct {
 	cache map[string]int64
+	// batches counts the calls to CheckRecords.
+	batches int
+	// warmed is the size of each call to WarmRecords.
+	warmed []int
+	err    error
+}
+
+func (mc *mockCache) WarmRecords(_ context.Context, records []Scan) error {
+	if mc.err != nil {
+		return mc.err
+	}
+	mc.warmed = append(mc.warmed, len(records))
+	for _, record := range records {
+		if record.Timestamp > mc.cache[record.Key()] {
+			mc.cache[record.Key()] = record.Timestamp
+		}
+	}
+	return nil
+}
+
+func (mc *mockCache) RestoreRecords(_ context.Context, restores []RecordRestore) (int64, error) {
+	var restored int64
+	for _, r := range restores {
+		key := r.Record.Key()
+		if val, ok := mc.cache[key]; !ok || val != r.Record.Timestamp {
+			continue
+		}
+		if r.Previous == 0 {
+			delete(mc.cache, key)
+		} else {
+			mc.cache[key] = r.Previous
+		}
+		restored++
+	}
+	return restored, nil
 }
 
-func (mc *mockCache) RemoveRecords(ctx context.Context, records []Scan) (int64, error) {
-	mc.cache = map[string]int64{}
-	return 0, nil
+func (mc *mockCache) CheckRecord(ctx context.Context, record Scan) (RecordStatus, error) {
+	check := mc.check(record)
+	return check.Status, nil
 }
-func (mc *mockCache) RecordIsNew(_ context.Context, record Scan) (bool, error) {
-	key := fmt.Sprintf("%s-%d-%s", record.Ip, record.Port, record.Service)
+
+func (mc *mockCache) CheckRecords(_ context.Context, records []Scan) ([]RecordCheck, error) {
+	mc.batches++
+	if mc.err != nil {
+		return nil, mc.err
+	}
+	checks := make([]RecordCheck, len(records))
+	for i, record := range records {
+		checks[i] = mc.check(record)
+	}
+	return checks, nil
+}
+
+func (mc *mockCache) check(record Scan) RecordCheck {
+	key := record.Key()
 	val, ok := mc.cache[key]
 	if !ok {
 		mc.cache[key] = record.Timestamp
-		return true, nil
+		return RecordCheck{Status: RecordNew}
+	}
+	if record.Timestamp <= val {
+		return RecordCheck{Status: RecordStale}
 	}
-	return record.Timestamp > val, nil
+	mc.cache[key] = record.Timestamp
+	return RecordCheck{Status: RecordNewer, Previous: val}
 }
 
 type mockRepo struct {
 	err      error
 	res      []Scan
 	timesHit int
+	// poison fails any batch that has one of these keys in it, the same way a
+	// bad row fails the whole transaction.
+	poison map[string]bool
+	// flaky fails any batch that has one of these keys in it with a transient
+	// error, like the data store going away, unless a poison key fails it first.
+	flaky map[string]bool
+	calls int
+	// history is everything passed to RecordHistory.
+	history      []Scan
+	historyErr   error
+	historyCalls int
 }
 
-func (m *mockRepo) UpsertMany(_ context.Context, scans []Scan) error {
+func (m *mockRepo) RecordHistory(_ context.Context, scans []Scan) error {
+	m.historyCalls++
+	if m.historyErr != nil {
+		return m.historyErr
+	}
+	m.history = append(m.history, scans...)
+	return nil
+}
+
+func (m *mockRepo) UpsertMany(_ context.Context, scans []Scan) (UpsertStats, error) {
+	m.calls++
 	if m.err != nil {
-		return m.err
+		return UpsertStats{}, m.err
+	}
+	for _, scan := range scans {
+		if m.poison[scan.Key()] {
+			return UpsertStats{}, fmt.Errorf("%w: test-error: bad record %s", ErrRecordRejected, scan.Key())
+		}
+	}
+	for _, scan := range scans {
+		if m.flaky[scan.Key()] {
+			return UpsertStats{}, errors.New("test-error: connection reset")
+		}
 	}
 	m.res = append(m.res, scans...)
 	m.timesHit++
-	return nil
+	return UpsertStats{New: len(scans)}, nil
 }
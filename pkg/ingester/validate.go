@@ -0,0 +1,227 @@
+package ingester
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/scanning"
+)
+
+// ErrInvalidScan is matched by every [ValidationError], for when the reason
+// doesn't matter.
+var ErrInvalidScan = errors.New("invalid scan")
+
+// ValidationReason is a short, machine friendly description of why a scan
+// was rejected. These are used as metric labels, so keep the list short.
+type ValidationReason string
+
+const (
+	// ValidationInvalidIP is an ip that doesn't parse.
+	ValidationInvalidIP ValidationReason = "invalid_ip"
+	// ValidationReservedIP is an ip that can't be a real host on the
+	// internet: unspecified, loopback, multicast, link local, private or set
+	// aside for documentation and the like.
+	ValidationReservedIP ValidationReason = "reserved_ip"
+	// ValidationInvalidPort is a port outside of 1-65535.
+	ValidationInvalidPort ValidationReason = "invalid_port"
+	// ValidationInvalidTransport is a transport we don't know about.
+	ValidationInvalidTransport ValidationReason = "invalid_transport"
+	// ValidationInvalidService is a missing or malformed service name, or
+	// one that isn't in the allowed list.
+	ValidationInvalidService ValidationReason = "invalid_service"
+	// ValidationTimestampSkew is a timestamp too far in the future, or
+	// further in the past than we accept.
+	ValidationTimestampSkew ValidationReason = "timestamp_skew"
+)
+
+// ValidationError is returned by [Validator.Validate] for a scan that should
+// never be saved.
+type ValidationError struct {
+	Reason ValidationReason
+	// Value is the offending value, as sent.
+	Value string
+	msg   string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrInvalidScan, e.Reason, e.msg)
+}
+
+// Is lets errors.Is(err, ErrInvalidScan) match any validation error.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidScan
+}
+
+func invalid(reason ValidationReason, value, format string, args ...any) *ValidationError {
+	return &ValidationError{Reason: reason, Value: value, msg: fmt.Sprintf(format, args...)}
+}
+
+// reservedPrefixes are special purpose ranges that aren't covered by the
+// netip helpers.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("100::/64"),
+}
+
+// transports are the ones the scanner knows about.
+var transports = map[string]bool{
+	scanning.TransportTCP:  true,
+	scanning.TransportUDP:  true,
+	scanning.TransportQUIC: true,
+}
+
+// maxServiceLength is a sanity limit on service names.
+const maxServiceLength = 32
+
+// Validator checks that a decoded scan makes sense before it's handed to the
+// upserter. Without it, garbage that happens to be valid json ends up failing
+// whole batches in the database, or worse, saved.
+type Validator struct {
+	services     map[string]bool
+	maxSkew      time.Duration
+	maxAge       time.Duration
+	allowPrivate bool
+	now          func() time.Time
+}
+
+// ValidatorOption provides additional configuration for the [Validator]
+type ValidatorOption func(*Validator)
+
+// WithAllowedServices only lets through scans for the listed services. The
+// comparison is done after normalizing, so case doesn't matter. Without it,
+// any well formed service name is allowed.
+func WithAllowedServices(services ...string) ValidatorOption {
+	return func(v *Validator) {
+		v.services = make(map[string]bool, len(services))
+		for _, s := range services {
+			v.services[normalizeService(s)] = true
+		}
+	}
+}
+
+// WithMaxClockSkew is how far into the future a timestamp can be, to allow for
+// scanners with clocks running a little fast. Defaults to 5 minutes.
+func WithMaxClockSkew(d time.Duration) ValidatorOption {
+	return func(v *Validator) {
+		v.maxSkew = d
+	}
+}
+
+// WithMaxAge rejects scans older than the duration. Zero, the default,
+// accepts anything after the epoch.
+func WithMaxAge(d time.Duration) ValidatorOption {
+	return func(v *Validator) {
+		v.maxAge = d
+	}
+}
+
+// WithAllowPrivate lets through ips in private ranges, for when the scanner
+// is pointed at an internal network.
+func WithAllowPrivate() ValidatorOption {
+	return func(v *Validator) {
+		v.allowPrivate = true
+	}
+}
+
+// NewValidator creates a validator with the provided options.
+func NewValidator(opts ...ValidatorOption) *Validator {
+	v := &Validator{
+		maxSkew: time.Minute * 5,
+		now:     time.Now,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Validate checks the scan, returning a [*ValidationError] for the first
+// problem found. The transport and service are normalized in place, so scans
+// for "http" and "HTTP " are the same row, as are "" and "tcp".
+func (v *Validator) Validate(s *Scan) error {
+	addr, err := ParseIP(s.Ip)
+	if err != nil {
+		return invalid(ValidationInvalidIP, s.Ip, "%q is not an ip address", s.Ip)
+	}
+	if v.reserved(addr) {
+		return invalid(ValidationReservedIP, s.Ip, "%s is not a public address", s.Ip)
+	}
+
+	if s.Port < 1 || s.Port > 65535 {
+		return invalid(ValidationInvalidPort, fmt.Sprint(s.Port), "port %d is out of range", s.Port)
+	}
+
+	transport := NormalizeTransport(s.Transport)
+	if !transports[transport] {
+		return invalid(ValidationInvalidTransport, s.Transport, "%q is not a known transport", s.Transport)
+	}
+	s.Transport = transport
+
+	service := normalizeService(s.Service)
+	if !validServiceName(service) {
+		return invalid(ValidationInvalidService, s.Service, "%q is not a valid service name", s.Service)
+	}
+	if v.services != nil && !v.services[service] {
+		return invalid(ValidationInvalidService, s.Service, "service %q is not allowed", service)
+	}
+	s.Service = service
+
+	now := v.now()
+	ts := s.Time()
+	switch {
+	case s.Timestamp <= 0:
+		return invalid(ValidationTimestampSkew, fmt.Sprint(s.Timestamp), "timestamp %d is not after the epoch", s.Timestamp)
+	case ts.After(now.Add(v.maxSkew)):
+		return invalid(ValidationTimestampSkew, fmt.Sprint(s.Timestamp), "timestamp %s is in the future", ts.UTC().Format(time.RFC3339))
+	case v.maxAge > 0 && ts.Before(now.Add(-v.maxAge)):
+		return invalid(ValidationTimestampSkew, fmt.Sprint(s.Timestamp), "timestamp %s is older than %s", ts.UTC().Format(time.RFC3339), v.maxAge)
+	}
+	return nil
+}
+
+func (v *Validator) reserved(addr netip.Addr) bool {
+	if addr.IsUnspecified() || addr.IsLoopback() || addr.IsMulticast() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return true
+	}
+	if addr.IsPrivate() {
+		return !v.allowPrivate
+	}
+	for _, p := range reservedPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeService(s string) string {
+	return strings.ToUpper(strings.TrimSpace(s))
+}
+
+// validServiceName allows letters, digits and a little punctuation, which
+// covers every service name the scanner knows about.
+func validServiceName(s string) bool {
+	if s == "" || len(s) > maxServiceLength {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
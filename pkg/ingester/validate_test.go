@@ -0,0 +1,132 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/censys/scan-takehome/pkg/scanning"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name     string
+		edit     func(*Scan)
+		opts     []ValidatorOption
+		expected ValidationReason
+		service  string
+	}{
+		{name: "valid", service: "DNS"},
+		{name: "ipv6", edit: func(s *Scan) { s.Ip = "2606:4700::1111" }, service: "DNS"},
+		{name: "service is normalized", edit: func(s *Scan) { s.Service = " http " }, service: "HTTP"},
+		{name: "garbage ip", edit: func(s *Scan) { s.Ip = "1.1.1" }, expected: ValidationInvalidIP},
+		{name: "empty ip", edit: func(s *Scan) { s.Ip = "" }, expected: ValidationInvalidIP},
+		{name: "zoned ip", edit: func(s *Scan) { s.Ip = "2606:4700::1111%eth0" }, expected: ValidationInvalidIP},
+		{name: "unspecified", edit: func(s *Scan) { s.Ip = "0.0.0.0" }, expected: ValidationReservedIP},
+		{name: "loopback", edit: func(s *Scan) { s.Ip = "::1" }, expected: ValidationReservedIP},
+		{name: "mapped loopback", edit: func(s *Scan) { s.Ip = "::ffff:127.0.0.1" }, expected: ValidationReservedIP},
+		{name: "multicast", edit: func(s *Scan) { s.Ip = "224.0.0.1" }, expected: ValidationReservedIP},
+		{name: "documentation", edit: func(s *Scan) { s.Ip = "192.0.2.10" }, expected: ValidationReservedIP},
+		{name: "private", edit: func(s *Scan) { s.Ip = "10.0.0.1" }, expected: ValidationReservedIP},
+		{name: "private allowed", edit: func(s *Scan) { s.Ip = "10.0.0.1" }, opts: []ValidatorOption{WithAllowPrivate()}, service: "DNS"},
+		{name: "port 0", edit: func(s *Scan) { s.Port = 0 }, expected: ValidationInvalidPort},
+		{name: "port too big", edit: func(s *Scan) { s.Port = 65536 }, expected: ValidationInvalidPort},
+		{name: "no transport is tcp", edit: func(s *Scan) { s.Transport = "" }, service: "DNS"},
+		{name: "quic", edit: func(s *Scan) { s.Transport = "QUIC" }, service: "DNS"},
+		{name: "unknown transport", edit: func(s *Scan) { s.Transport = "sctp" }, expected: ValidationInvalidTransport},
+		{name: "empty service", edit: func(s *Scan) { s.Service = "  " }, expected: ValidationInvalidService},
+		{name: "malformed service", edit: func(s *Scan) { s.Service = "HTTP; DROP TABLE" }, expected: ValidationInvalidService},
+		{
+			name:     "service not allowed",
+			opts:     []ValidatorOption{WithAllowedServices("http", "ssh")},
+			expected: ValidationInvalidService,
+		},
+		{name: "allowed service", opts: []ValidatorOption{WithAllowedServices("dns")}, service: "DNS"},
+		{name: "zero timestamp", edit: func(s *Scan) { s.Timestamp = 0 }, expected: ValidationTimestampSkew},
+		{name: "a little fast", edit: func(s *Scan) { s.Timestamp = now.Add(time.Minute).Unix() }, service: "DNS"},
+		{name: "too far in the future", edit: func(s *Scan) { s.Timestamp = now.Add(time.Hour).Unix() }, expected: ValidationTimestampSkew},
+		{name: "old is fine by default", edit: func(s *Scan) { s.Timestamp = now.AddDate(-5, 0, 0).Unix() }, service: "DNS"},
+		{
+			name:     "too old",
+			edit:     func(s *Scan) { s.Timestamp = now.Add(-time.Hour * 48).Unix() },
+			opts:     []ValidatorOption{WithMaxAge(time.Hour * 24)},
+			expected: ValidationTimestampSkew,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject := NewValidator(tt.opts...)
+			subject.now = func() time.Time { return now }
+			s := Scan{Scan: scanning.Scan{Ip: "1.1.1.1", Port: 53, Service: "DNS", Timestamp: now.Unix()}}
+			if tt.edit != nil {
+				tt.edit(&s)
+			}
+
+			err := subject.Validate(&s)
+			if tt.expected == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.service, s.Service)
+				return
+			}
+			var verr *ValidationError
+			if assert.ErrorAs(t, err, &verr) {
+				assert.Equal(t, tt.expected, verr.Reason)
+			}
+			assert.ErrorIs(t, err, ErrInvalidScan)
+		})
+	}
+}
+
+func TestReceiveMessageQuarantinesInvalidScans(t *testing.T) {
+	reserved := newScan(scanning.V2)
+	reserved.Ip = "127.0.0.1"
+
+	tests := []struct {
+		name           string
+		withQuarantine bool
+		quarantineErr  error
+		shouldAck      bool
+		shouldNack     bool
+	}{
+		{name: "quarantined", withQuarantine: true, shouldAck: true},
+		{name: "falls back to the dead letter sink", shouldAck: true},
+		{name: "nacked if quarantine fails", withQuarantine: true, quarantineErr: errors.New("test-error"), shouldNack: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, fn := context.WithTimeout(context.Background(), time.Second*5)
+			defer fn()
+			dlq := &mockDeadLetterer{}
+			quarantine := &mockDeadLetterer{err: tt.quarantineErr}
+			opts := []IngesterOption{WithDeadLetter(dlq), WithValidator(NewValidator())}
+			if tt.withQuarantine {
+				opts = append(opts, WithQuarantine(quarantine))
+			}
+			subject := NewIngester(zaptest.NewLogger(t), nil, opts...)
+			mm := newMockMsg()
+
+			go subject.receiveMessage(ctx, ScanToBytes(t, reserved), MessageInfo{ID: "msg-1"}, mm)
+			select {
+			case <-subject.SendChan:
+				assert.FailNow(t, "invalid scans should never make it to the upserter")
+			case <-mm.Done:
+			}
+
+			assert.Equal(t, tt.shouldAck, mm.acked)
+			assert.Equal(t, tt.shouldNack, mm.nacked)
+			letters := dlq.letters
+			if tt.withQuarantine {
+				letters = quarantine.letters
+				assert.Empty(t, dlq.letters)
+			}
+			if assert.Len(t, letters, 1) {
+				assert.Equal(t, ReasonInvalidScan, letters[0].Reason)
+				assert.Contains(t, letters[0].Error, string(ValidationReservedIP))
+			}
+		})
+	}
+}
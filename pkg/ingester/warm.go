@@ -0,0 +1,92 @@
+package ingester
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LastSeenQuery limits which saved scans are used to warm the cache.
+type LastSeenQuery struct {
+	// Since skips anything last seen before it. Zero means no limit.
+	Since time.Time
+	// Limit caps the number of scans, newest first. Zero means no limit.
+	Limit int
+}
+
+// LastSeenStreamer streams the newest saved scan for each ip/port/transport/service.
+// Only the key fields and the timestamp need to be set on the scans.
+type LastSeenStreamer interface {
+	StreamLastSeen(ctx context.Context, q LastSeenQuery, f func(Scan) error) error
+}
+
+// CacheWarmer is a cache that can be seeded with what's already saved.
+// Warming must only ever move a cached timestamp forward, since live traffic
+// is checked against the cache at the same time.
+type CacheWarmer interface {
+	WarmRecords(ctx context.Context, records []Scan) error
+}
+
+// WarmOptions tune [WarmCache]
+type WarmOptions struct {
+	Query LastSeenQuery
+	// BatchSize is how many scans are sent to the cache at once.
+	BatchSize int
+	// ProgressInterval is how often progress is logged.
+	ProgressInterval time.Duration
+}
+
+// WarmCache streams the last seen scans from the data store into the cache, so
+// a fresh or flushed cache doesn't treat every first scan as new. Returns the
+// number of scans loaded, which is still accurate when an error (including the
+// context ending) stops it early.
+func WarmCache(ctx context.Context, l *zap.Logger, src LastSeenStreamer, cache CacheWarmer, opts WarmOptions) (int, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.ProgressInterval <= 0 {
+		opts.ProgressInterval = time.Second * 10
+	}
+
+	start := time.Now()
+	lastLog := start
+	loaded := 0
+	batch := make([]Scan, 0, opts.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := cache.WarmRecords(ctx, batch); err != nil {
+			return err
+		}
+		loaded += len(batch)
+		batch = batch[:0]
+		if time.Since(lastLog) >= opts.ProgressInterval {
+			lastLog = time.Now()
+			l.Info("warming cache", zap.Int("loaded", loaded), zap.Duration("elapsed", time.Since(start)))
+		}
+		return nil
+	}
+
+	l.Info("warming cache from data store",
+		zap.Time("since", opts.Query.Since),
+		zap.Int("limit", opts.Query.Limit),
+	)
+	err := src.StreamLastSeen(ctx, opts.Query, func(scan Scan) error {
+		batch = append(batch, scan)
+		if len(batch) < opts.BatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		l.Warn("cache warm up stopped early", zap.Int("loaded", loaded), zap.Error(err))
+		return loaded, err
+	}
+	l.Info("cache warm up finished", zap.Int("loaded", loaded), zap.Duration("elapsed", time.Since(start)))
+	return loaded, nil
+}
@@ -0,0 +1,66 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestWarmCache(t *testing.T) {
+	scans := makeMessages(7)
+	src := &mockStreamer{scans: scans}
+	cache := &mockCache{cache: map[string]int64{}}
+	q := LastSeenQuery{Since: time.Now().Add(-time.Hour), Limit: 100}
+
+	loaded, err := WarmCache(context.Background(), zaptest.NewLogger(t), src, cache, WarmOptions{Query: q, BatchSize: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, loaded)
+	assert.Equal(t, q, src.query)
+	assert.Equal(t, []int{3, 3, 1}, cache.warmed)
+	for _, scan := range scans {
+		assert.Equal(t, scan.Timestamp, cache.cache[scan.Key()])
+	}
+}
+
+func TestWarmCacheStopsOnError(t *testing.T) {
+	ctx, fn := context.WithCancel(context.Background())
+	src := &mockStreamer{scans: makeMessages(10), cancelAfter: 4, cancel: fn}
+	cache := &mockCache{cache: map[string]int64{}}
+
+	loaded, err := WarmCache(ctx, zaptest.NewLogger(t), src, cache, WarmOptions{BatchSize: 2})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 4, loaded, "what was loaded before the deadline should be reported")
+
+	loaded, err = WarmCache(context.Background(), zaptest.NewLogger(t), src, &mockCache{err: errors.New("test-error")}, WarmOptions{})
+	assert.Error(t, err)
+	assert.Zero(t, loaded)
+}
+
+// mockStreamer streams its scans, cancelling the context after cancelAfter
+// scans if set.
+type mockStreamer struct {
+	scans       []Scan
+	query       LastSeenQuery
+	cancelAfter int
+	cancel      func()
+}
+
+func (m *mockStreamer) StreamLastSeen(ctx context.Context, q LastSeenQuery, f func(Scan) error) error {
+	m.query = q
+	for i, scan := range m.scans {
+		if m.cancel != nil && i == m.cancelAfter {
+			m.cancel()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(scan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// Namespace is the prefix every metric in the project shares.
+const Namespace = "miniscan"
+
+// registry is kept private so the only way in is through [Register], and the
+// only way out is through [Handler].
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Register adds collectors to the registry served on /metrics. Packages call
+// this to expose their own metrics, and anything else that wants to extend
+// what we export (custom collectors, build info, etc) can do the same.
+func Register(cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MustRegister is like [Register] but panics on error. Meant for package level
+// metrics registered in init().
+func MustRegister(cs ...prometheus.Collector) {
+	registry.MustRegister(cs...)
+}
+
+// Handler serves every registered metric in the prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// Serve exposes /metrics on the provided address until the context is done.
+func Serve(ctx context.Context, l *zap.Logger, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, fn := context.WithTimeout(context.Background(), time.Second*5)
+		defer fn()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			l.Error("failed to shut down metrics server", zap.Error(err))
+		}
+	}()
+
+	l.Info("serving metrics", zap.String("addr", addr))
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterCustomCollector(t *testing.T) {
+	custom := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "test_custom_total",
+		Help:      "A custom counter registered from outside the package.",
+	})
+	assert.NoError(t, Register(custom))
+	assert.Error(t, Register(custom), "registering the same collector twice should fail")
+	custom.Add(3)
+
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+	res, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal("failed to get metrics", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "miniscan_test_custom_total 3")
+	assert.Contains(t, string(body), "go_goroutines")
+}
@@ -4,11 +4,23 @@ const (
 	Version = iota
 	V1
 	V2
+	V3
+)
+
+// Transports a service can be scanned over. The same port can run different
+// services over each, eg DNS over both udp/53 and tcp/53.
+const (
+	TransportTCP  = "tcp"
+	TransportUDP  = "udp"
+	TransportQUIC = "quic"
 )
 
 type Scan struct {
-	Ip          string      `json:"ip"`
-	Port        uint32      `json:"port"`
+	Ip   string `json:"ip"`
+	Port uint32 `json:"port"`
+	// Transport is one of the Transport constants. Scanners from before it
+	// was sent only scanned over tcp, so a missing transport means tcp.
+	Transport   string      `json:"transport,omitempty"`
 	Service     string      `json:"service"`
 	Timestamp   int64       `json:"timestamp"`
 	DataVersion int         `json:"data_version"`
@@ -22,3 +34,48 @@ type V1Data struct {
 type V2Data struct {
 	ResponseStr string `json:"response_str"`
 }
+
+// V3Data is the raw response along with whatever the scanner could make of it
+// for the protocol. Only the section for the scan's service is set, and it's
+// left out entirely when the response couldn't be parsed.
+type V3Data struct {
+	ResponseStr string `json:"response_str"`
+	ProtocolData
+}
+
+// ProtocolData holds the structured, per protocol part of a scan.
+type ProtocolData struct {
+	HTTP *HTTPData `json:"http,omitempty"`
+	SSH  *SSHData  `json:"ssh,omitempty"`
+	DNS  *DNSData  `json:"dns,omitempty"`
+}
+
+// Empty is true when there's no protocol section at all.
+func (p ProtocolData) Empty() bool {
+	return p.HTTP == nil && p.SSH == nil && p.DNS == nil
+}
+
+type HTTPData struct {
+	StatusCode int                 `json:"status_code"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Title      string              `json:"title,omitempty"`
+	// BodySHA256 is the hex encoded sha256 of the response body.
+	BodySHA256 string `json:"body_sha256,omitempty"`
+}
+
+type SSHData struct {
+	Banner            string   `json:"banner"`
+	KexAlgorithms     []string `json:"kex_algorithms,omitempty"`
+	HostKeyAlgorithms []string `json:"host_key_algorithms,omitempty"`
+}
+
+type DNSData struct {
+	Answers []DNSAnswer `json:"answers,omitempty"`
+}
+
+type DNSAnswer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
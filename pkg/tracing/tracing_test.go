@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestSetupFileExporter(t *testing.T) {
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+
+	shutdown, err := Setup(context.Background(), Config{
+		ServiceName: "test-service",
+		Exporter:    ExporterFile,
+		Path:        path,
+		SampleRatio: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "test-span")
+	span.End()
+	assert.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 1) {
+		var exported struct {
+			Name     string
+			Resource []struct {
+				Key   string
+				Value struct{ Value any }
+			}
+		}
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &exported))
+		assert.Equal(t, "test-span", exported.Name)
+		resource := map[string]any{}
+		for _, attr := range exported.Resource {
+			resource[attr.Key] = attr.Value.Value
+		}
+		assert.Equal(t, "test-service", resource["service.name"])
+	}
+}
+
+func TestSetupWithoutExporter(t *testing.T) {
+	otel.SetTracerProvider(noop.NewTracerProvider())
+	shutdown, err := Setup(context.Background(), Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	_, span := otel.Tracer("test").Start(context.Background(), "test-span")
+	assert.False(t, span.IsRecording(), "spans shouldn't be recorded without an exporter")
+}
+
+func TestSetupUnknownExporter(t *testing.T) {
+	_, err := Setup(context.Background(), Config{Exporter: "carrier-pigeon"})
+	assert.Error(t, err)
+}